@@ -10,15 +10,45 @@ export RUNC_PATH=github.com/opencontainers/runc
 mv $SRC/runc-fuzzers/fs2_fuzzer.go $SRC/runc/libcontainer/cgroups/fs2/
 compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzGetStats get_stats_fuzzer
 compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzCgroupReader cgroup_reader_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzCgroupFreeze cgroup_freeze_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerWithCgroupV2Memory cgroup_v2_memory_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzCgroupPathMode cgroup_path_mode_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerWithLinuxHugeTlb hugetlb_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzCgroupEventsParse cgroup_events_parse_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerCgroupsCleanup cgroups_cleanup_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzParseCgroupV2Controllers parse_cgroup_v2_controllers_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxCpuShares cpu_shares_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxCpuQuota cpu_quota_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxIoMax io_max_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxCgroupV2IoLatency io_latency_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxCgroupV2IoPressure io_pressure_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxCpuUsageDelta cpu_usage_delta_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs2 FuzzContainerLinuxWithCpuBandwidth cpu_bandwidth_fuzzer
 
 mv $SRC/runc-fuzzers/specconv_fuzzer.go $SRC/runc/libcontainer/specconv/
 compile_go_fuzzer $RUNC_PATH/libcontainer/specconv Fuzz specconv_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecAnnotations spec_annotations_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzMountOrdering mount_ordering_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzContainerSpecAnnotationsToConfig spec_annotations_to_config_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzRecursiveBindMountFlags recursive_bind_mount_flags_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzMountFlagClearing mount_flag_clearing_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzContainerLinuxSysfsMount sysfs_mount_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzDeviceDefaultsMerge device_defaults_merge_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecCapabilitiesNil spec_capabilities_nil_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecUTSNames spec_uts_names_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecSeccompFlags spec_seccomp_flags_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecNetworkTrafficClass network_traffic_class_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzSpecMountConversion spec_mount_conversion_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/specconv FuzzContainerLinuxRootlessDevices rootless_devices_fuzzer
 
 mv $SRC/runc-fuzzers/devices_fuzzer.go $SRC/runc/libcontainer/cgroups/devices
 compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/devices Fuzz devices_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/devices FuzzDevicesCgroupV1Writer devices_cgroup_v1_writer_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/devices FuzzDevicePermissionsNormalize device_permissions_normalize_fuzzer
 
 mv $SRC/runc-fuzzers/fscommon_fuzzer.go $SRC/runc/libcontainer/cgroups/fscommon/
 compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fscommon FuzzSecurejoin securejoin_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fscommon FuzzParseFdInfo parse_fdinfo_fuzzer
 
 mv $SRC/runc-fuzzers/intelrdt_fuzzer.go $SRC/runc/libcontainer/intelrdt/
 compile_go_fuzzer $RUNC_PATH/libcontainer/intelrdt FuzzFindMpDir find_mountpoint_dir_fuzzer
@@ -27,3 +57,93 @@ compile_go_fuzzer $RUNC_PATH/libcontainer/intelrdt FuzzParseMonFeatures parse_mo
 
 mv $SRC/runc-fuzzers/libcontainer_fuzzer.go $SRC/runc/libcontainer/
 compile_go_fuzzer $RUNC_PATH/libcontainer FuzzStateApi state_api_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerPivotRoot pivot_root_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxExecFifoPath exec_fifo_path_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerStateFileLocking state_file_locking_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzUnmarshalBaseState unmarshal_base_state_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerWithNonRootUser non_root_user_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzIntelRdtGroupName intelrdt_group_name_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerWithMultipleNamespaces multiple_namespaces_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerWithPidNamespace pid_namespace_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerWithIPC ipc_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxKernelKeyring kernel_keyring_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerWithNetworkNamespaceJoin netns_join_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzCriuRestoreNamespaces criu_restore_namespaces_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxTmpMount tmp_mount_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxPassedFDs passed_fds_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzMemoryPressureLevel memory_pressure_level_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerStateLabels state_labels_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzRootfsReadonlyRemount rootfs_readonly_remount_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxAppArmorInteraction apparmor_interaction_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerDestroyIdempotency destroy_idempotency_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithCgroupNs cgroupns_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithUTSNamespace uts_namespace_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzProcessAdditionalGids additional_gids_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxKvmDevice kvm_device_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzMountNamespaceSetupOrder mount_setup_order_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithLargeMount large_mount_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxBindMountSource bind_mount_source_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxNetworkRoute network_route_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxExecPathResolution exec_path_resolution_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWaitGroup waitgroup_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxFDCloseExec fd_close_exec_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxMountDataOption mount_data_option_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithTimeoutedInit timeouted_init_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxSyncPipe sync_pipe_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxNetNsPath netns_path_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithSubreaper subreaper_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithHugePageTlbSharing hugepage_tlb_sharing_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer FuzzContainerLinuxWithNonRootNS non_root_ns_fuzzer
+
+mv $SRC/runc-fuzzers/cgroups_fuzzer.go $SRC/runc/libcontainer/cgroups/
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups FuzzContainerWithCgroupV1v2Coexistence cgroup_v1v2_coexistence_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups FuzzGetPids get_pids_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups FuzzParseMountinfoFields parse_mountinfo_fields_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups FuzzCgroupModeDetection cgroup_mode_detection_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups FuzzExecCgroupAttach exec_cgroup_attach_fuzzer
+
+mv $SRC/runc-fuzzers/systemd_fuzzer.go $SRC/runc/libcontainer/cgroups/systemd/
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/systemd FuzzContainerCpuSet cpuset_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/systemd FuzzExpandSliceRoundTrip expand_slice_fuzzer
+
+mv $SRC/runc-fuzzers/capabilities_fuzzer.go $SRC/runc/libcontainer/capabilities/
+compile_go_fuzzer $RUNC_PATH/libcontainer/capabilities FuzzProcessCapsInheritance caps_inheritance_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/capabilities FuzzContainerLinuxNoCaps no_caps_fuzzer
+
+mv $SRC/runc-fuzzers/seccomp_fuzzer.go $SRC/runc/libcontainer/seccomp/
+compile_go_fuzzer $RUNC_PATH/libcontainer/seccomp FuzzSeccompSyscallNames seccomp_syscall_names_fuzzer seccomp
+compile_go_fuzzer $RUNC_PATH/libcontainer/seccomp FuzzContainerLinuxSeccompDefaultAction seccomp_default_action_fuzzer seccomp
+
+mv $SRC/runc-fuzzers/fs_fuzzer.go $SRC/runc/libcontainer/cgroups/fs/
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzCgroupResourcesMaxValues cgroup_resources_max_values_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzCgroupFreezerState cgroup_freezer_state_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzContainerLinuxNetPrio net_prio_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzContainerLinuxNetCls net_cls_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzContainerLinuxDevicePermissions device_permissions_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzContainerLinuxCgroupPath cgroup_path_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzCgroupStatMemoryHierarchy memory_stat_hierarchy_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzCgroupFreezerStateMachine freezer_state_machine_fuzzer
+compile_go_fuzzer $RUNC_PATH/libcontainer/cgroups/fs FuzzCgroupV1v2Routing cgroup_v1v2_routing_fuzzer
+
+mv $SRC/runc-fuzzers/logs_fuzzer.go $SRC/runc/libcontainer/logs/
+compile_go_fuzzer $RUNC_PATH/libcontainer/logs FuzzLogLevel log_level_fuzzer
+
+mv $SRC/runc-fuzzers/validate_fuzzer.go $SRC/runc/libcontainer/configs/validate/
+compile_go_fuzzer $RUNC_PATH/libcontainer/configs/validate FuzzValidateIntelRdt validate_intelrdt_fuzzer
+
+mv $SRC/runc-fuzzers/system_fuzzer.go $SRC/runc/libcontainer/system/
+compile_go_fuzzer $RUNC_PATH/libcontainer/system FuzzParsePIDStatState parse_pid_stat_state_fuzzer
+
+mv $SRC/runc-fuzzers/user_fuzzer.go $SRC/runc/libcontainer/user/
+compile_go_fuzzer $RUNC_PATH/libcontainer/user FuzzParseSubIDRanges parse_subid_ranges_fuzzer
+
+# go-fuzz cannot build fuzzers in a main package, so the
+# runc command is turned into an importable package first:
+mv $SRC/runc-fuzzers/runc_fuzzer.go $SRC/runc/
+sed -i 's/^package main$/package runc/' $SRC/runc/*.go
+compile_go_fuzzer $RUNC_PATH FuzzProcessSpecValidation process_spec_validation_fuzzer
+compile_go_fuzzer $RUNC_PATH FuzzProcessRlimits process_rlimits_fuzzer
+compile_go_fuzzer $RUNC_PATH FuzzExecProcessJSON exec_process_json_fuzzer
+compile_go_fuzzer $RUNC_PATH FuzzMemoryLimitUnits memory_limit_units_fuzzer
+compile_go_fuzzer $RUNC_PATH FuzzSpecVersion spec_version_fuzzer
+compile_go_fuzzer $RUNC_PATH FuzzConsoleSocketPath console_socket_path_fuzzer
@@ -0,0 +1,313 @@
+// +build gofuzz
+
+package capabilities
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/gocapability/capability"
+)
+
+// capNames returns the names of all known capabilities, sorted
+// so that the fuzzer picks the same name for the same input.
+func capNames() []string {
+	names := make([]string, 0, len(capabilityMap))
+	for name := range capabilityMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getCapList creates a list of mostly valid capability names.
+func getCapList(c *gofuzzheaders.ConsumeFuzzer, names []string) ([]string, error) {
+	n, err := c.GetInt()
+	if err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for i := 0; i < n%16; i++ {
+		b, err := c.GetInt()
+		if err != nil {
+			return nil, err
+		}
+		if b%4 == 0 {
+			s, err := c.GetString()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, s)
+			continue
+		}
+		list = append(list, names[b%len(names)])
+	}
+	return list, nil
+}
+
+func getCapabilities(c *gofuzzheaders.ConsumeFuzzer, names []string) (*configs.Capabilities, error) {
+	var err error
+	caps := &configs.Capabilities{}
+	for _, l := range []*[]string{&caps.Bounding, &caps.Effective, &caps.Inheritable, &caps.Permitted, &caps.Ambient} {
+		if *l, err = getCapList(c, names); err != nil {
+			return nil, err
+		}
+	}
+	return caps, nil
+}
+
+// capMask returns the capabilities of type t of w as a mask.
+func capMask(w *Caps, t capability.CapType) uint64 {
+	var m uint64
+	for _, v := range w.caps[t] {
+		m |= 1 << uint(v)
+	}
+	return m
+}
+
+// FuzzProcessCapsInheritance computes the capabilities of an exec'd
+// process the way newInitConfig() does: it gets its own capabilities
+// if it has any, otherwise it inherits those of the container. runc
+// keeps the requested capabilities as they are and does not check them
+// against the container's bounding set, so they are applied on a
+// thread that already has the capabilities of the container, which is
+// thrown away afterwards. The kernel has to reject or leave out
+// whatever the exec'd process requests outside of the container's
+// bounding set and permitted capabilities.
+func FuzzProcessCapsInheritance(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	names := capNames()
+	containerCaps, err := getCapabilities(c, names)
+	if err != nil {
+		return -1
+	}
+	hasExecCaps, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	var execCaps *configs.Capabilities
+	if hasExecCaps {
+		if execCaps, err = getCapabilities(c, names); err != nil {
+			return -1
+		}
+	}
+
+	caps := containerCaps
+	if execCaps != nil {
+		caps = execCaps
+	}
+	cw, err := New(containerCaps)
+	if err != nil {
+		return 0
+	}
+	w, err := New(caps)
+	if err != nil {
+		return 0
+	}
+
+	for t, list := range map[capability.CapType][]string{
+		capability.BOUNDING:    caps.Bounding,
+		capability.EFFECTIVE:   caps.Effective,
+		capability.INHERITABLE: caps.Inheritable,
+		capability.PERMITTED:   caps.Permitted,
+		capability.AMBIENT:     caps.Ambient,
+	} {
+		allowed := make(map[capability.Cap]bool)
+		for _, name := range list {
+			if v, ok := capabilityMap[name]; ok {
+				allowed[v] = true
+			}
+		}
+		for _, v := range w.caps[t] {
+			if !allowed[v] {
+				panic(fmt.Sprintf("%s: %s was not requested by the process", t, v))
+			}
+		}
+		if len(allowed) > 0 && len(w.caps[t]) == 0 {
+			panic(fmt.Sprintf("%s: requested capabilities were dropped", t))
+		}
+	}
+
+	type result struct {
+		container, exec map[string]uint64
+		err             error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.err = cw.ApplyBoundingSet(); res.err != nil {
+			return
+		}
+		if res.err = cw.ApplyCaps(); res.err != nil {
+			return
+		}
+		if res.container, res.err = threadCaps(); res.err != nil {
+			return
+		}
+		if res.err = w.ApplyBoundingSet(); res.err != nil {
+			return
+		}
+		if res.err = w.ApplyCaps(); res.err != nil {
+			return
+		}
+		res.exec, res.err = threadCaps()
+	}()
+	res := <-resCh
+	if res.err != nil {
+		// The kernel rejected the capabilities.
+		return 0
+	}
+
+	bounding := capMask(cw, capability.BOUNDING)
+	if res.exec["CapBnd"]&^(bounding&res.container["CapBnd"]) != 0 {
+		panic(fmt.Sprintf("exec bounding set %#x is outside of the container's %#x", res.exec["CapBnd"], bounding))
+	}
+	if added := res.exec["CapInh"] &^ res.container["CapInh"]; added&^bounding != 0 {
+		panic(fmt.Sprintf("exec added inheritable capabilities %#x outside of the container's bounding set %#x", added, bounding))
+	}
+	if res.exec["CapPrm"]&^res.container["CapPrm"] != 0 {
+		panic(fmt.Sprintf("exec permitted capabilities %#x exceed the container's %#x", res.exec["CapPrm"], res.container["CapPrm"]))
+	}
+	if res.exec["CapEff"]&^res.exec["CapPrm"] != 0 || res.exec["CapAmb"]&^(res.exec["CapPrm"]&res.exec["CapInh"]) != 0 {
+		panic(fmt.Sprintf("exec capabilities are inconsistent: %v", res.exec))
+	}
+	return 1
+}
+
+// threadCaps reads the capability sets of the calling
+// thread the way capsh --print shows them.
+func threadCaps() (map[string]uint64, error) {
+	f, err := os.Open("/proc/thread-self/status")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sets := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "Cap") {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		sets[kv[0]] = v
+	}
+	return sets, s.Err()
+}
+
+// FuzzContainerLinuxNoCaps applies capabilities ranging from all of
+// them to none the way finalizeNamespace() does: the bounding set is
+// reduced first, while CAP_SETPCAP is still held, and then the other
+// sets are applied. Capabilities are per thread, so this is done on a
+// thread that is thrown away. The user is not changed, so keeping the
+// capabilities across setuid(2) is not needed.
+func FuzzContainerLinuxNoCaps(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	names := capNames()
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var caps *configs.Capabilities
+	switch mode % 3 {
+	case 0:
+		caps = &configs.Capabilities{Bounding: names, Effective: names, Inheritable: names, Permitted: names, Ambient: names}
+	case 1:
+		caps = &configs.Capabilities{}
+	case 2:
+		if caps, err = getCapabilities(c, names); err != nil {
+			return -1
+		}
+	}
+	w, err := New(caps)
+	if err != nil {
+		return 0
+	}
+
+	type result struct {
+		before, after map[string]uint64
+		err           error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.before, res.err = threadCaps(); res.err != nil {
+			return
+		}
+		if res.err = w.ApplyBoundingSet(); res.err != nil {
+			return
+		}
+		if res.err = w.ApplyCaps(); res.err != nil {
+			return
+		}
+		res.after, res.err = threadCaps()
+	}()
+	res := <-resCh
+	if res.err != nil {
+		return 0
+	}
+
+	mask := func(t capability.CapType) uint64 {
+		var m uint64
+		for _, v := range w.caps[t] {
+			m |= 1 << uint(v)
+		}
+		return m
+	}
+	bounding := mask(capability.BOUNDING)
+	expected := map[string]uint64{
+		// Capabilities that are not in the bounding set
+		// of the fuzzer can not be added back:
+		"CapBnd": bounding & res.before["CapBnd"],
+		"CapEff": mask(capability.EFFECTIVE),
+		"CapInh": mask(capability.INHERITABLE),
+		"CapPrm": mask(capability.PERMITTED),
+		// Raising an ambient capability that is not both permitted
+		// and inheritable fails, but the error is ignored, so it is
+		// silently left out:
+		"CapAmb": mask(capability.AMBIENT) & mask(capability.PERMITTED) & mask(capability.INHERITABLE),
+	}
+	for set, v := range expected {
+		if res.after[set] != v {
+			panic(fmt.Sprintf("%s: expected %#x, got %#x (config %+v)", set, v, res.after[set], *caps))
+		}
+	}
+	// The kernel does not allow effective capabilities
+	// that are not permitted:
+	if res.after["CapEff"]&^res.after["CapPrm"] != 0 {
+		panic(fmt.Sprintf("effective capabilities %#x are not permitted: %#x", res.after["CapEff"], res.after["CapPrm"]))
+	}
+	// The bounding set only limits what can be added to the
+	// inheritable set; ambient capabilities have to be both
+	// permitted and inheritable:
+	if res.after["CapAmb"]&^(res.after["CapPrm"]&res.after["CapInh"]) != 0 {
+		panic(fmt.Sprintf("ambient capabilities %#x are not permitted and inheritable: %#x, %#x",
+			res.after["CapAmb"], res.after["CapPrm"], res.after["CapInh"]))
+	}
+	return 1
+}
@@ -0,0 +1,465 @@
+// +build gofuzz
+
+package cgroups
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/moby/sys/mountinfo"
+)
+
+// v1Subsystems are the controllers the coexistence fuzzer may place
+// on a legacy (v1) hierarchy.
+var v1Subsystems = []string{"cpu", "cpuacct", "memory", "pids", "devices", "freezer"}
+
+func newMountinfoLine(id int, root, mountpoint, fstype, vfsOpts string) string {
+	return fmt.Sprintf("%d 1 0:%d %s %s rw,nosuid,nodev,noexec,relatime shared:%d - %s %s %s\n",
+		id, id, root, mountpoint, id, fstype, fstype, vfsOpts)
+}
+
+// FuzzContainerWithCgroupV1v2Coexistence detects the v1 hierarchies in
+// a mock mount table with a cgroup2 mount next to them, at a fuzzed
+// path. How the v1 manager routes resources to the hierarchies it is
+// given is fuzzed by FuzzCgroupV1v2Routing in the fs package.
+func FuzzContainerWithCgroupV1v2Coexistence(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+
+	// Decide which controllers live on cgroup v1. Everything
+	// else is considered to be on the cgroup2 mount.
+	onV1 := make(map[string]bool)
+	for _, s := range v1Subsystems {
+		b, err := c.GetBool()
+		if err != nil {
+			return -1
+		}
+		onV1[s] = b
+	}
+	unifiedPath, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	if unifiedPath == "" || strings.ContainsAny(unifiedPath, " \t\n") {
+		unifiedPath = "/sys/fs/cgroup/unified"
+	}
+	hybridSystemd, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	extra, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+
+	// Create the mock /proc/self/mountinfo:
+	var sb strings.Builder
+	id := 20
+	sb.WriteString(newMountinfoLine(id, "/", "/sys/fs/cgroup", "tmpfs", "ro,mode=755"))
+	id++
+	sb.WriteString(newMountinfoLine(id, "/", unifiedPath, "cgroup2", "rw,nsdelegate"))
+	if hybridSystemd {
+		id++
+		sb.WriteString(newMountinfoLine(id, "/", "/sys/fs/cgroup/systemd", "cgroup", "rw,xattr,name=systemd"))
+	}
+	for _, s := range v1Subsystems {
+		if !onV1[s] {
+			continue
+		}
+		id++
+		sb.WriteString(newMountinfoLine(id, "/", "/sys/fs/cgroup/"+s, "cgroup", "rw,"+s))
+	}
+	sb.WriteString(extra)
+
+	// Filter the mounts the same way readCgroupMountinfo() does,
+	// but keep all of them to check that against:
+	all, err := mountinfo.GetMountsFromReader(strings.NewReader(sb.String()), nil)
+	if err != nil {
+		return 0
+	}
+	var mounts []*mountinfo.Info
+	v1Mountpoints := make(map[string]bool)
+	v2Mountpoints := make(map[string]bool)
+	filter := mountinfo.FSTypeFilter("cgroup")
+	for _, mi := range all {
+		switch mi.FSType {
+		case "cgroup":
+			v1Mountpoints[mi.Mountpoint] = true
+		case "cgroup2":
+			v2Mountpoints[mi.Mountpoint] = true
+		}
+		if skip, _ := filter(mi); !skip {
+			mounts = append(mounts, mi)
+		}
+	}
+
+	ss := map[string]bool{CgroupNamePrefix + "systemd": false}
+	for _, s := range v1Subsystems {
+		ss[s] = false
+	}
+	res1, err := getCgroupMountsHelper(ss, mounts, false)
+	if err != nil {
+		return 0
+	}
+
+	// The cgroup2 mount must never be considered a v1 hierarchy:
+	for _, m := range res1 {
+		if v2Mountpoints[m.Mountpoint] && !v1Mountpoints[m.Mountpoint] {
+			panic(fmt.Sprintf("cgroup2 mount %q reported as a v1 hierarchy", m.Mountpoint))
+		}
+	}
+
+	// Each subsystem must be routed to exactly one v1 hierarchy.
+	seen := make(map[string]string)
+	for _, m := range res1 {
+		for _, s := range m.Subsystems {
+			if prev, ok := seen[s]; ok {
+				panic(fmt.Sprintf("subsystem %q routed to both %q and %q", s, prev, m.Mountpoint))
+			}
+			seen[s] = m.Mountpoint
+		}
+	}
+
+	for _, s := range v1Subsystems {
+		mnt, _, err := findCgroupMountpointAndRootFromMI(mounts, "", s)
+		if err != nil {
+			if !IsNotFound(err) {
+				panic(fmt.Sprintf("unexpected error for subsystem %q: %v", s, err))
+			}
+			if _, ok := seen[s]; ok {
+				panic(fmt.Sprintf("subsystem %q detected but not found", s))
+			}
+			continue
+		}
+		if seen[s] != mnt {
+			panic(fmt.Sprintf("subsystem %q routed to %q, but found at %q", s, seen[s], mnt))
+		}
+		// The mock v1 mounts come before the extra lines:
+		if onV1[s] && mnt != "/sys/fs/cgroup/"+s {
+			panic(fmt.Sprintf("subsystem %q mounted on v1 was found at %q", s, mnt))
+		}
+	}
+
+	return 1
+}
+
+func FuzzGetPids(data []byte) int {
+	dir, err := ioutil.TempDir("", "fuzz-pids")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, CgroupProcesses), data, 0o644); err != nil {
+		return -1
+	}
+
+	pids, err := GetPids(dir)
+	if err != nil {
+		return 0
+	}
+
+	// Blank lines are skipped; every other line is a single pid.
+	// Lines are split like bufio.ScanLines does, which also drops
+	// a trailing "\r" from every line.
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if line := s.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(pids) != len(lines) {
+		panic(fmt.Sprintf("expected %d pids, got %d", len(lines), len(pids)))
+	}
+	for i, pid := range pids {
+		if n, err := strconv.Atoi(lines[i]); err != nil || n != pid {
+			panic(fmt.Sprintf("line %q was read as pid %d", lines[i], pid))
+		}
+	}
+
+	// Sub-cgroups must be included in the pids of the cgroup:
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, CgroupProcesses), data, 0o644); err != nil {
+		return -1
+	}
+	all, err := GetAllPids(dir)
+	if err != nil {
+		panic(fmt.Sprintf("failed to read pids of %s: %v", dir, err))
+	}
+	if len(all) != 2*len(pids) {
+		panic(fmt.Sprintf("expected %d pids including sub-cgroups, got %d", 2*len(pids), len(all)))
+	}
+	return 1
+}
+
+// mountinfoToken makes s usable as a single field of a mountinfo line.
+// A field cannot be the "-" separator and is not octal escaped.
+func mountinfoToken(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\\':
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "-" {
+		return "_"
+	}
+	return s
+}
+
+// FuzzParseMountinfoFields parses a mountinfo line with a varying number
+// of optional fields between the mount options and the "-" separator.
+// The fields after the separator are found by searching backwards for
+// it, so they must line up for any number of optional fields.
+func FuzzParseMountinfoFields(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	ids := struct {
+		ID, Parent, Major, Minor uint16
+	}{}
+	if err := c.GenerateStruct(&ids); err != nil {
+		return -1
+	}
+	var fields [7]string
+	for i := range fields {
+		s, err := c.GetString()
+		if err != nil {
+			return -1
+		}
+		fields[i] = mountinfoToken(s)
+	}
+	root, mountpoint, options, fstype, source, vfsOptions := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	hasSep, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	optional := make([]string, n)
+	for i := range optional {
+		switch i % 3 {
+		case 0:
+			optional[i] = fmt.Sprintf("shared:%d", i)
+		case 1:
+			optional[i] = fmt.Sprintf("master:%d", i)
+		case 2:
+			optional[i] = fields[6]
+		}
+	}
+
+	line := []string{
+		strconv.Itoa(int(ids.ID)), strconv.Itoa(int(ids.Parent)),
+		fmt.Sprintf("%d:%d", ids.Major, ids.Minor), root, mountpoint, options,
+	}
+	line = append(line, optional...)
+	if hasSep {
+		line = append(line, "-")
+	}
+	line = append(line, fstype, source, vfsOptions)
+
+	mounts, err := mountinfo.GetMountsFromReader(strings.NewReader(strings.Join(line, " ")+"\n"), nil)
+	if !hasSep {
+		if err == nil {
+			panic(fmt.Sprintf("line without separator was parsed as %+v", mounts))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %q: %v", strings.Join(line, " "), err))
+	}
+	if len(mounts) != 1 {
+		panic(fmt.Sprintf("expected 1 mount, got %d", len(mounts)))
+	}
+	expected := mountinfo.Info{
+		ID:         int(ids.ID),
+		Parent:     int(ids.Parent),
+		Major:      int(ids.Major),
+		Minor:      int(ids.Minor),
+		Root:       root,
+		Mountpoint: mountpoint,
+		Options:    options,
+		Optional:   strings.Join(optional, " "),
+		FSType:     fstype,
+		Source:     source,
+		VFSOptions: vfsOptions,
+	}
+	if *mounts[0] != expected {
+		panic(fmt.Sprintf("%d optional fields: expected %+v, got %+v", n, expected, *mounts[0]))
+	}
+	return 1
+}
+
+// cgroupModeMounts are the mounts a host may have
+// below /sys/fs/cgroup, in any combination.
+var cgroupModeMounts = []struct {
+	mountpoint, fstype, vfsOpts string
+}{
+	{"/sys/fs/cgroup", "tmpfs", "ro,mode=755"},
+	{"/sys/fs/cgroup", "cgroup2", "rw,nsdelegate"},
+	{"/sys/fs/cgroup/unified", "cgroup2", "rw,nsdelegate"},
+	{"/sys/fs/cgroup/systemd", "cgroup", "rw,xattr,name=systemd"},
+	{"/sys/fs/cgroup/memory", "cgroup", "rw,memory"},
+	{"/sys/fs/cgroup/cpu,cpuacct", "cgroup", "rw,cpu,cpuacct"},
+	{"/sys/fs/cgroup/pids", "cgroup", "rw,pids"},
+}
+
+// FuzzCgroupModeDetection looks up the v1 hierarchies in fuzzed mount
+// tables of legacy (cgroup v1), hybrid (cgroup v1 with a cgroup2 mount
+// below it) and unified (cgroup v2) hosts. runc itself tells cgroup v2
+// from the rest with statfs(2) on /sys/fs/cgroup, which can only see
+// the host, so only the mount table lookups are fuzzed. Both of them
+// must only find controllers on "cgroup" mounts, and agree on where
+// each one is mounted.
+func FuzzCgroupModeDetection(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var sb strings.Builder
+	for id := 20; ; id++ {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		if i >= len(cgroupModeMounts) {
+			// Anything else, including contradictory lines:
+			s, err := c.GetString()
+			if err != nil {
+				break
+			}
+			sb.WriteString(s + "\n")
+			continue
+		}
+		m := cgroupModeMounts[i]
+		sb.WriteString(newMountinfoLine(id, "/", m.mountpoint, m.fstype, m.vfsOpts))
+	}
+
+	mounts, err := mountinfo.GetMountsFromReader(strings.NewReader(sb.String()), nil)
+	if err != nil {
+		return 0
+	}
+	// This is what readCgroupMountinfo() filters on:
+	cgroupMounts, err := mountinfo.GetMountsFromReader(strings.NewReader(sb.String()), mountinfo.FSTypeFilter("cgroup"))
+	if err != nil {
+		panic(fmt.Sprintf("mount table parsed once, but not twice: %v", err))
+	}
+
+	subsystems := []string{"memory", "cpu", "cpuacct", "pids", "name=systemd"}
+	ss := make(map[string]bool)
+	for _, s := range subsystems {
+		ss[s] = false
+	}
+	res, err := getCgroupMountsHelper(ss, cgroupMounts, false)
+	if err != nil {
+		return 0
+	}
+	for _, s := range subsystems {
+		mnt, root, err := findCgroupMountpointAndRootFromMI(cgroupMounts, "", s)
+		var found *Mount
+		for i := range res {
+			for _, sub := range res[i].Subsystems {
+				if sub == strings.TrimPrefix(s, CgroupNamePrefix) {
+					found = &res[i]
+				}
+			}
+		}
+		if err != nil {
+			if found != nil {
+				panic(fmt.Sprintf("%s was not found, but is mounted at %q", s, found.Mountpoint))
+			}
+			continue
+		}
+		if found == nil || found.Mountpoint != mnt || found.Root != root {
+			panic(fmt.Sprintf("%s was found at %q (root %q), but listed as %+v", s, mnt, root, found))
+		}
+		onCgroup := false
+		for _, mi := range mounts {
+			if mi.FSType != "cgroup" || mi.Mountpoint != mnt || mi.Root != root {
+				continue
+			}
+			for _, opt := range strings.Split(mi.VFSOptions, ",") {
+				if opt == s {
+					onCgroup = true
+				}
+			}
+		}
+		if !onCgroup {
+			panic(fmt.Sprintf("%s was found at %q, which is not a cgroup mount of it", s, mnt))
+		}
+	}
+	return 1
+}
+
+// FuzzExecCgroupAttach attaches a fuzzed pid to the cgroups of a
+// container the way an exec'd process is attached, with EnterPid(),
+// in a mock cgroupfs. The pid is not validated: -1 is skipped, and any
+// other pid is written to cgroup.procs as is, leaving it to the kernel
+// to reject. Cgroups that do not exist are skipped, not created.
+func FuzzExecCgroupAttach(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	kind, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var pid int
+	switch kind % 3 {
+	case 0:
+		pid = -1
+	case 1:
+		pid = kind / 3
+	case 2:
+		v, err := c.GetUint64()
+		if err != nil {
+			return -1
+		}
+		pid = int(int64(v))
+	}
+	existing, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+
+	TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-exec-attach")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	paths := make(map[string]string)
+	for i, s := range v1Subsystems {
+		paths[s] = filepath.Join(dir, s, "container")
+		if existing&(1<<uint(i)) != 0 {
+			if err := os.MkdirAll(paths[s], 0o755); err != nil {
+				return -1
+			}
+		}
+	}
+
+	if err := EnterPid(paths, pid); err != nil {
+		panic(fmt.Sprintf("failed to attach pid %d: %v", pid, err))
+	}
+	for i, s := range v1Subsystems {
+		content, err := ioutil.ReadFile(filepath.Join(paths[s], CgroupProcesses))
+		switch {
+		case existing&(1<<uint(i)) == 0:
+			if PathExists(paths[s]) {
+				panic(fmt.Sprintf("missing %s cgroup was created", s))
+			}
+		case pid == -1:
+			if !os.IsNotExist(err) {
+				panic(fmt.Sprintf("pid -1 was written to the %s cgroup: %q", s, content))
+			}
+		case err != nil || string(content) != strconv.Itoa(pid):
+			panic(fmt.Sprintf("pid %d was written to the %s cgroup as %q: %v", pid, s, content, err))
+		}
+	}
+	return 1
+}
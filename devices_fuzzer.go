@@ -1,8 +1,12 @@
 package devices
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
-    gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/opencontainers/runc/libcontainer/devices"
 )
 
 func Fuzz(data []byte) int {
@@ -29,3 +33,178 @@ func Fuzz(data []byte) int {
 	emu1.Transition(emu2)
 	return 1
 }
+
+// cgroupRuleRegex matches a single line that the kernel accepts in
+// devices.allow and devices.deny.
+var cgroupRuleRegex = regexp.MustCompile(`^[abc] (\*|[0-9]+):(\*|[0-9]+) r?w?m?$`)
+
+var ruleTypes = []devices.Type{
+	devices.WildcardDevice,
+	devices.BlockDevice,
+	devices.CharDevice,
+	devices.FifoDevice,
+}
+
+func getRule(c *gofuzzheaders.ConsumeFuzzer) (*devices.Rule, error) {
+	t, err := c.GetInt()
+	if err != nil {
+		return nil, err
+	}
+	nums := struct {
+		Major int64
+		Minor int64
+	}{}
+	if err := c.GenerateStruct(&nums); err != nil {
+		return nil, err
+	}
+	// Negative numbers other than the wildcard are never valid
+	// device numbers, so fold them into the wildcard.
+	if nums.Major < 0 {
+		nums.Major = devices.Wildcard
+	}
+	if nums.Minor < 0 {
+		nums.Minor = devices.Wildcard
+	}
+	// The permissions are taken in any order and may contain
+	// duplicates, just like they can in a runtime spec.
+	p, err := c.GetBytes()
+	if err != nil {
+		return nil, err
+	}
+	var perms strings.Builder
+	for _, b := range p {
+		perms.WriteByte("rwm"[int(b)%3])
+	}
+	allow, err := c.GetBool()
+	if err != nil {
+		return nil, err
+	}
+	return &devices.Rule{
+		Type:        ruleTypes[t%len(ruleTypes)],
+		Major:       nums.Major,
+		Minor:       nums.Minor,
+		Permissions: devices.Permissions(perms.String()),
+		Allow:       allow,
+	}, nil
+}
+
+// FuzzDevicesCgroupV1Writer emulates the cgroup v1 devices controller
+// the same way fs.DevicesGroup.Set does, and checks that every line it
+// would write to devices.allow or devices.deny is well-formed.
+func FuzzDevicesCgroupV1Writer(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	list, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	current, err := EmulatorFromList(strings.NewReader(list))
+	if err != nil {
+		return -1
+	}
+
+	// This defaults to a white-list, like buildEmulator does.
+	target := &Emulator{}
+	for {
+		rule, err := getRule(c)
+		if err != nil {
+			break
+		}
+		if err := target.Apply(*rule); err != nil {
+			if rule.Type.CanCgroup() {
+				panic(fmt.Sprintf("failed to apply valid rule %+v: %v", rule, err))
+			}
+			return 0
+		}
+	}
+
+	rules, err := current.Transition(target)
+	if err != nil {
+		return 0
+	}
+	for _, rule := range rules {
+		line := rule.CgroupString()
+		if !cgroupRuleRegex.MatchString(line) || rule.Permissions.IsEmpty() {
+			panic(fmt.Sprintf("malformed device rule %q", line))
+		}
+		if !rule.Permissions.IsValid() {
+			panic(fmt.Sprintf("invalid permissions in device rule %q", line))
+		}
+		if rule.Type == devices.WildcardDevice && line != "a *:* rwm" {
+			panic(fmt.Sprintf("wildcard device rule %q does not cover all devices", line))
+		}
+	}
+	return 1
+}
+
+// canonicalPermissions lists every subset of "rwm" in the fixed order
+// that devices.Permissions uses when it builds a string from a set.
+var canonicalPermissions = []devices.Permissions{
+	"", "r", "w", "m", "rw", "rm", "wm", "rwm",
+}
+
+// FuzzDevicePermissionsNormalize checks the normalization done by the
+// set operations on devices.Permissions. runc has no dedicated
+// normalization function; Union, Intersection and Difference all go
+// through the same set and back, which drops duplicates and unknown
+// characters and emits the permissions in "rwm" order. Note that
+// IsValid only accepts that canonical form, so a spec rule with
+// "wrm" is reported as invalid although it only holds valid modes.
+func FuzzDevicePermissionsNormalize(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	raw, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	order, err := c.GetBytes()
+	if err != nil {
+		return -1
+	}
+
+	p := devices.Permissions(raw)
+	norm := p.Union("")
+
+	var want strings.Builder
+	for _, perm := range "rwm" {
+		if strings.ContainsRune(raw, perm) {
+			want.WriteRune(perm)
+		}
+	}
+	if string(norm) != want.String() {
+		panic(fmt.Sprintf("%q normalized to %q, expected %q", raw, norm, want.String()))
+	}
+	canonical := false
+	for _, cp := range canonicalPermissions {
+		if norm == cp {
+			canonical = true
+			break
+		}
+	}
+	if !canonical || !norm.IsValid() {
+		panic(fmt.Sprintf("%q normalized to non-canonical %q", raw, norm))
+	}
+	if norm.Union("") != norm {
+		panic(fmt.Sprintf("normalizing %q is not idempotent", norm))
+	}
+	if p.Intersection("rwm") != norm || p.Difference("") != norm {
+		panic(fmt.Sprintf("set operations on %q disagree with %q", raw, norm))
+	}
+	if p.IsValid() && p != norm {
+		panic(fmt.Sprintf("%q is valid but normalizes to %q", raw, norm))
+	}
+
+	// Any permutation of the input, with or without duplicates, has
+	// to normalize to the same permissions.
+	perm := []byte(raw)
+	for i, b := range order {
+		if len(perm) < 2 {
+			break
+		}
+		j := int(b) % len(perm)
+		perm[i%len(perm)], perm[j] = perm[j], perm[i%len(perm)]
+	}
+	perm = append(perm, perm...)
+	if got := devices.Permissions(perm).Union(""); got != norm {
+		panic(fmt.Sprintf("permutation %q of %q normalized to %q, expected %q", perm, raw, got, norm))
+	}
+	return 1
+}
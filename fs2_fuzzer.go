@@ -3,11 +3,24 @@
 package fs2
 
 import (
+	"bufio"
 	"bytes"
     "errors"
+    "fmt"
+    "io/ioutil"
+    "math"
     "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "unsafe"
     "github.com/opencontainers/runc/libcontainer/cgroups"
+    "github.com/opencontainers/runc/libcontainer/cgroups/fs"
+    "github.com/opencontainers/runc/libcontainer/cgroups/fscommon"
+    "github.com/opencontainers/runc/libcontainer/configs"
     gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+    "golang.org/x/sys/unix"
 )
 
 func FuzzCgroupReader(data []byte) int {
@@ -122,3 +135,1177 @@ func FuzzGetStats(data []byte) int {
     _ = statCpu("/tmp", &stats5)
     return 1
 }
+
+func FuzzCgroupFreeze(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	frozen, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	events, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+
+	if frozen {
+		// waitFrozen retries for 10 seconds until the first "frozen "
+		// line says 1, and the kernel never leaves its value empty:
+		scanner := bufio.NewScanner(strings.NewReader(events))
+		for scanner.Scan() {
+			if val := strings.TrimPrefix(scanner.Text(), "frozen "); val != scanner.Text() {
+				if val == "" || val[0] != '1' {
+					return 0
+				}
+				break
+			}
+		}
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-freezer")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	freeze := "0\n"
+	if frozen {
+		freeze = "1\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.freeze"), []byte(freeze), 0o644); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.events"), []byte(events), 0o644); err != nil {
+		return -1
+	}
+
+	state, err := getFreezer(dir)
+	if err != nil {
+		return 0
+	}
+	switch {
+	case !frozen && state != configs.Thawed:
+		panic(fmt.Sprintf("expected %q, got %q", configs.Thawed, state))
+	case frozen && state == configs.Thawed:
+		panic(fmt.Sprintf("%q reported while cgroup.freeze is 1", state))
+	case state == configs.Frozen && !strings.HasPrefix(events, "frozen 1") && !strings.Contains(events, "\nfrozen 1"):
+		panic(fmt.Sprintf("%q reported without \"frozen 1\" in cgroup.events: %q", state, events))
+	}
+	return 1
+}
+
+// getMemoryLimit returns either one of the special
+// limit values or an arbitrary fuzz-controlled value.
+func getMemoryLimit(c *gofuzzheaders.ConsumeFuzzer) (int64, error) {
+	t, err := c.GetInt()
+	if err != nil {
+		return 0, err
+	}
+	switch t % 4 {
+	case 0:
+		return -1, nil
+	case 1:
+		return 0, nil
+	case 2:
+		return math.MaxInt64, nil
+	}
+	var v struct{ Limit int64 }
+	if err := c.GenerateStruct(&v); err != nil {
+		return 0, err
+	}
+	return v.Limit, nil
+}
+
+// memoryWrites returns the names of the files in the directory watched
+// by the inotify instance fd that were written to, in order.
+func memoryWrites(fd int) ([]string, error) {
+	var names []string
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(fd, buf)
+		if errors.Is(err, unix.EAGAIN) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			names = append(names, string(bytes.TrimRight(name, "\x00")))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
+
+// memoryValue parses a memory.max or memory.high value, where "max"
+// is no limit.
+func memoryValue(s string) (uint64, bool) {
+	if s == "max" {
+		return math.MaxUint64, true
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	return v, err == nil
+}
+
+// FuzzContainerWithCgroupV2Memory sets the memory limits of a cgroup
+// that already has a memory.max and memory.high with manager.Set(),
+// and records the order of the writes with inotify. memory.high can
+// only be set through Unified, which is written after everything else,
+// so memory.swap.max, memory.max and memory.low are written first, in
+// that order. The kernel does not reject a memory.high above
+// memory.max, and neither does runc, but with memory.max written first
+// raising both limits never goes through such a state, while lowering
+// memory.max below the current memory.high does.
+func FuzzContainerWithCgroupV2Memory(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var limits [7]int64
+	for i := range limits {
+		l, err := getMemoryLimit(c)
+		if err != nil {
+			return -1
+		}
+		limits[i] = l
+	}
+	r := &configs.Resources{
+		Memory:            limits[0],
+		MemorySwap:        limits[1],
+		MemoryReservation: limits[2],
+		Unified: map[string]string{
+			"memory.high": numToStr(limits[3]),
+			"memory.min":  numToStr(limits[4]),
+		},
+		SkipDevices: true,
+	}
+	oldMax, oldHigh := numToStr(limits[5]), numToStr(limits[6])
+	if oldMax == "" {
+		oldMax = "max"
+	}
+	if oldHigh == "" {
+		oldHigh = "max"
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-memory")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"cgroup.controllers": "memory",
+		"memory.max":         oldMax,
+		"memory.high":        oldHigh,
+	}
+	for file, val := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(val), 0o644); err != nil {
+			return -1
+		}
+	}
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return -1
+	}
+	defer unix.Close(fd)
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE); err != nil {
+		return -1
+	}
+	m := &manager{
+		config:  &configs.Cgroup{Resources: r},
+		dirPath: dir,
+	}
+	if err := m.Set(r); err != nil {
+		return 0
+	}
+	writes, err := memoryWrites(fd)
+	if err != nil {
+		return -1
+	}
+
+	// Every limit must end up in its file unmodified:
+	expected := map[string]string{
+		"memory.high": r.Unified["memory.high"],
+		"memory.min":  r.Unified["memory.min"],
+	}
+	if val := numToStr(r.Memory); val != "" {
+		expected["memory.max"] = val
+	}
+	if val := numToStr(r.MemoryReservation); val != "" {
+		expected["memory.low"] = val
+	}
+	for file, val := range expected {
+		got, err := cgroups.ReadFile(dir, file)
+		if err != nil {
+			panic(fmt.Sprintf("%s was not written: %v", file, err))
+		}
+		if got != val {
+			panic(fmt.Sprintf("%s: expected %q, got %q", file, val, got))
+		}
+	}
+	if swap, err := cgroups.ReadFile(dir, "memory.swap.max"); err == nil && swap == "" {
+		panic("empty value written to memory.swap.max")
+	}
+
+	// The writes are ordered like in setMemory() and setUnified():
+	order := map[string]int{"memory.swap.max": 0, "memory.max": 1, "memory.low": 2, "memory.high": 3, "memory.min": 3}
+	last := 0
+	for _, file := range writes {
+		i, ok := order[file]
+		if !ok {
+			panic(fmt.Sprintf("unexpected write to %s", file))
+		}
+		if i < last {
+			panic(fmt.Sprintf("%s written out of order: %v", file, writes))
+		}
+		last = i
+	}
+
+	// Replay the writes on memory.max and memory.high:
+	state := map[string]string{"memory.max": oldMax, "memory.high": oldHigh}
+	exceeded := false
+	for _, file := range writes {
+		if _, ok := state[file]; !ok {
+			continue
+		}
+		if state[file], err = cgroups.ReadFile(dir, file); err != nil {
+			return -1
+		}
+		max, ok1 := memoryValue(state["memory.max"])
+		high, ok2 := memoryValue(state["memory.high"])
+		exceeded = exceeded || (ok1 && ok2 && high > max)
+	}
+	oldMaxV, ok1 := memoryValue(oldMax)
+	oldHighV, ok2 := memoryValue(oldHigh)
+	newMaxV, ok3 := memoryValue(state["memory.max"])
+	newHighV, ok4 := memoryValue(state["memory.high"])
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return 0
+	}
+	if exceeded && oldHighV <= oldMaxV && newHighV <= newMaxV && newMaxV >= oldMaxV {
+		panic(fmt.Sprintf("memory.high exceeded memory.max going from %s/%s to %s/%s: %v",
+			oldHigh, oldMax, state["memory.high"], state["memory.max"], writes))
+	}
+	return 1
+}
+
+func FuzzCgroupPathMode(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	cg := &configs.Cgroup{}
+	for _, field := range []*string{&cg.Path, &cg.Parent, &cg.Name} {
+		set, err := c.GetBool()
+		if err != nil {
+			return -1
+		}
+		if !set {
+			continue
+		}
+		if *field, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+
+	path, err := defaultDirPath(cg)
+	if cg.Path != "" && (cg.Parent != "" || cg.Name != "") {
+		if err == nil {
+			panic(fmt.Sprintf("both Path and Parent/Name accepted: %+v", cg))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+
+	// The resolved path must stay inside the cgroup hierarchy:
+	if path != UnifiedMountpoint && !strings.HasPrefix(path, UnifiedMountpoint+"/") {
+		panic(fmt.Sprintf("%+v resolved to %q, outside of %q", cg, path, UnifiedMountpoint))
+	}
+	if filepath.Clean(path) != path {
+		panic(fmt.Sprintf("%+v resolved to unclean path %q", cg, path))
+	}
+	return 1
+}
+
+func FuzzContainerWithLinuxHugeTlb(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	hostSizes, _ := cgroups.GetHugePageSize()
+
+	// Create the limits. Page sizes are either
+	// taken from the host or fuzz-controlled.
+	// The number of limits is bounded, so that
+	// there is input left for the stats files.
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	r := &configs.Resources{}
+	expected := make(map[string]string)
+	for i := 0; i < n%(len(hostSizes)+2); i++ {
+		t, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		var l struct{ Limit uint64 }
+		if err := c.GenerateStruct(&l); err != nil {
+			return -1
+		}
+		pagesize := ""
+		if len(hostSizes) > 0 && t%2 == 0 {
+			pagesize = hostSizes[t%len(hostSizes)]
+		} else {
+			if pagesize, err = c.GetString(); err != nil {
+				return -1
+			}
+			// The fake cgroupfs does not protect
+			// against writes outside of dir:
+			if strings.Contains(pagesize, "/") {
+				return -1
+			}
+		}
+		switch t % 3 {
+		case 0:
+			l.Limit = 0
+		case 1:
+			l.Limit = math.MaxUint64
+		}
+		r.HugetlbLimit = append(r.HugetlbLimit, &configs.HugepageLimit{
+			Pagesize: pagesize,
+			Limit:    l.Limit,
+		})
+		expected["hugetlb."+pagesize+".max"] = strconv.FormatUint(l.Limit, 10)
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-hugetlb")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	if err := setHugeTlb(dir, r); err != nil {
+		return 0
+	}
+	for file, val := range expected {
+		got, err := cgroups.ReadFile(dir, file)
+		if err != nil {
+			panic(fmt.Sprintf("%s was not written: %v", file, err))
+		}
+		if got != val {
+			panic(fmt.Sprintf("%s: expected %q, got %q", file, val, got))
+		}
+	}
+
+	// Read the stats back from files that either hold
+	// well-formed values or fuzz-controlled content:
+	expectedStats := make(map[string]cgroups.HugetlbStats)
+	for _, pagesize := range hostSizes {
+		raw, err := c.GetBool()
+		if err != nil {
+			return 0
+		}
+		var current, events string
+		if raw {
+			if current, err = c.GetString(); err != nil {
+				return 0
+			}
+			if events, err = c.GetString(); err != nil {
+				return 0
+			}
+		} else {
+			var v struct{ Usage, Failcnt uint64 }
+			if err := c.GenerateStruct(&v); err != nil {
+				return 0
+			}
+			current = strconv.FormatUint(v.Usage, 10) + "\n"
+			events = "max " + strconv.FormatUint(v.Failcnt, 10) + "\n"
+			expectedStats[pagesize] = cgroups.HugetlbStats{Usage: v.Usage, Failcnt: v.Failcnt}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "hugetlb."+pagesize+".current"), []byte(current), 0o644); err != nil {
+			return 0
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "hugetlb."+pagesize+".events"), []byte(events), 0o644); err != nil {
+			return 0
+		}
+	}
+	stats := cgroups.NewStats()
+	if err := statHugeTlb(dir, stats); err != nil {
+		return 0
+	}
+	if len(stats.HugetlbStats) != len(hostSizes) {
+		panic(fmt.Sprintf("expected stats for %d page sizes, got %d", len(hostSizes), len(stats.HugetlbStats)))
+	}
+	for pagesize, want := range expectedStats {
+		if got := stats.HugetlbStats[pagesize]; got != want {
+			panic(fmt.Sprintf("hugetlb stats for %s: expected %+v, got %+v", pagesize, want, got))
+		}
+	}
+	return 1
+}
+
+// FuzzCgroupEventsParse parses a cgroup.events style file with both
+// key/value parsers used by the event readers, and checks that they
+// agree on the "populated" and "frozen" flags.
+func FuzzCgroupEventsParse(data []byte) int {
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-events")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.events"), data, 0o644); err != nil {
+		return -1
+	}
+
+	// ParseKeyValue accepts an empty key, as in " 0". For
+	// duplicate keys the first line wins.
+	type event struct {
+		value uint64
+		err   error
+	}
+	events := make(map[string]event)
+	for _, line := range strings.Split(string(data), "\n") {
+		_, value, err := fscommon.ParseKeyValue(line)
+		if parts := strings.SplitN(line, " ", 3); len(parts) == 2 {
+			if _, ok := events[parts[0]]; !ok {
+				events[parts[0]] = event{value: value, err: err}
+			}
+		}
+	}
+
+	for _, key := range []string{"populated", "frozen"} {
+		value, err := fscommon.GetValueByKey(dir, "cgroup.events", key)
+		e := events[key]
+		switch {
+		case e.err != nil && err == nil:
+			panic(fmt.Sprintf("malformed %q line was read as %d", key, value))
+		case e.err == nil && err != nil:
+			panic(fmt.Sprintf("failed to read %q: %v", key, err))
+		case err == nil && value != e.value:
+			panic(fmt.Sprintf("%q is %d, expected %d", key, value, e.value))
+		}
+	}
+	return 1
+}
+
+// FuzzContainerCgroupsCleanup destroys a mock container cgroup with
+// fuzz-controlled sub-cgroups. Regular files stand in for cgroups
+// that still have processes, since those cannot be removed either.
+func FuzzContainerCgroupsCleanup(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	tmp, err := ioutil.TempDir("", "fuzz-cleanup")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(tmp)
+
+	// A directory outside of the cgroup that must never be touched:
+	outside := filepath.Join(tmp, "outside")
+	if err := os.MkdirAll(filepath.Join(outside, "sub"), 0o755); err != nil {
+		return -1
+	}
+	dirPath := filepath.Join(tmp, "container")
+	removedExternally, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	populated := false
+	if !removedExternally {
+		if err := os.Mkdir(dirPath, 0o755); err != nil {
+			return -1
+		}
+		dirs := []string{dirPath}
+		for {
+			op, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			name, err := c.GetString()
+			if err != nil {
+				break
+			}
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+				continue
+			}
+			p := filepath.Join(dirs[op%len(dirs)], name)
+			switch op % 3 {
+			case 0:
+				if err := os.Mkdir(p, 0o755); err == nil {
+					dirs = append(dirs, p)
+				}
+			case 1:
+				if err := ioutil.WriteFile(p, []byte("1\n"), 0o644); err == nil {
+					populated = true
+				}
+			case 2:
+				if err := os.Symlink(outside, p); err == nil {
+					populated = true
+				}
+			}
+		}
+	}
+
+	m := &manager{
+		config:  &configs.Cgroup{},
+		dirPath: dirPath,
+	}
+	err = m.Destroy()
+
+	// Destroy must never follow symlinks out of the cgroup:
+	if _, statErr := os.Stat(filepath.Join(outside, "sub")); statErr != nil {
+		panic(fmt.Sprintf("directory outside of the cgroup was removed: %v", statErr))
+	}
+	_, statErr := os.Stat(dirPath)
+	exists := statErr == nil
+	switch {
+	case err == nil && exists:
+		panic(fmt.Sprintf("cgroup %s leaked without an error", dirPath))
+	case err != nil && !exists:
+		panic(fmt.Sprintf("cgroup %s was removed, but got error: %v", dirPath, err))
+	case !populated && err != nil:
+		panic(fmt.Sprintf("failed to remove cgroup %s without processes: %v", dirPath, err))
+	}
+	return 1
+}
+
+// FuzzParseCgroupV2Controllers parses a cgroup.controllers file the
+// way the manager does in Set(). The controllers are only used to tell
+// why a unified resource could not be written: the error names the
+// controller if it is not listed. runc only writes
+// cgroup.subtree_control, below /sys/fs/cgroup, and never reads it.
+func FuzzParseCgroupV2Controllers(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	content, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	ctrl, err := c.GetString()
+	if err != nil || ctrl == "" || strings.ContainsAny(ctrl, "./\x00") {
+		return -1
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-controllers")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte(content), 0o644); err != nil {
+		return -1
+	}
+	// A dangling symlink makes the write fail with ENOENT:
+	key := ctrl + ".fuzz"
+	if err := os.Symlink(filepath.Join(dir, "missing", key), filepath.Join(dir, key)); err != nil {
+		return -1
+	}
+
+	m, err := NewManager(&configs.Cgroup{Resources: &configs.Resources{}}, dir, false)
+	if err != nil {
+		return -1
+	}
+	err = m.Set(&configs.Resources{
+		SkipDevices: true,
+		Unified:     map[string]string{key: "1"},
+	})
+	if err == nil {
+		panic(fmt.Sprintf("unified resource %q was written through a dangling symlink", key))
+	}
+
+	listed := ctrl == "cgroup"
+	for _, f := range strings.Fields(content) {
+		if f == ctrl {
+			listed = true
+		}
+	}
+	if strings.Contains(err.Error(), "not available") == listed {
+		panic(fmt.Sprintf("controller %q (listed: %t) in %q: %v", ctrl, listed, content, err))
+	}
+	return 1
+}
+
+// cpuSharesValues are the cgroup v1 cpu.shares boundaries:
+// the kernel accepts [2, 262144].
+var cpuSharesValues = []uint64{0, 1, 2, 3, 1024, 262143, 262144, 262145, math.MaxUint64}
+
+// FuzzContainerLinuxCpuShares converts cpu.shares to cpu.weight the way
+// specconv does, and writes the weight. The conversion maps [2, 262144]
+// onto [1, 10000], so the default of 1024 shares becomes a weight of 39,
+// not the cgroup v2 default of 100. There is no conversion back.
+// Shares outside of that range are not clamped: 1 share underflows and
+// more than 262144 shares exceed 10000. setCpu writes whatever weight
+// the conversion gives, and leaves rejecting it to the kernel.
+func FuzzContainerLinuxCpuShares(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var shares uint64
+	if i < len(cpuSharesValues) {
+		shares = cpuSharesValues[i]
+	} else {
+		v := struct{ Shares uint64 }{}
+		if err := c.GenerateStruct(&v); err != nil {
+			return -1
+		}
+		shares = v.Shares
+	}
+
+	weight := cgroups.ConvertCPUSharesToCgroupV2Value(shares)
+	switch {
+	case shares == 0:
+		if weight != 0 {
+			panic(fmt.Sprintf("unset shares converted to weight %d", weight))
+		}
+	case shares >= 2 && shares <= 262144:
+		if weight < 1 || weight > 10000 {
+			panic(fmt.Sprintf("shares %d converted to weight %d", shares, weight))
+		}
+		if shares < 262144 && cgroups.ConvertCPUSharesToCgroupV2Value(shares+1) < weight {
+			panic(fmt.Sprintf("shares %d and %d convert to decreasing weights", shares, shares+1))
+		}
+		if shares == 2 && weight != 1 {
+			panic(fmt.Sprintf("minimum shares converted to weight %d", weight))
+		}
+		if shares == 262144 && weight != 10000 {
+			panic(fmt.Sprintf("maximum shares converted to weight %d", weight))
+		}
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-cpu-shares")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := setCpu(dir, &configs.Resources{CpuWeight: weight}); err != nil {
+		return 0
+	}
+	got, err := cgroups.ReadFile(dir, "cpu.weight")
+	if weight == 0 {
+		if err == nil {
+			panic(fmt.Sprintf("cpu.weight %q written for unset shares", got))
+		}
+		return 0
+	}
+	if err != nil || got != strconv.FormatUint(weight, 10) {
+		panic(fmt.Sprintf("weight %d was written as %q: %v", weight, got, err))
+	}
+	return 1
+}
+
+// cpuQuotaValues and cpuPeriodValues are the CFS bandwidth boundaries:
+// the kernel accepts periods of [1ms, 1s] and quotas of at least 1ms,
+// or -1 for no limit.
+var (
+	cpuQuotaValues  = []int64{0, -1, -2, 999, 1000, 50000, 100000, 200000, math.MaxInt64, math.MinInt64}
+	cpuPeriodValues = []uint64{0, 1, 999, 1000, 100000, 1000000, 1000001, math.MaxUint64}
+)
+
+// FuzzContainerLinuxCpuQuota sets the CFS quota and period on both the
+// cgroup v1 cpu controller and cgroup v2 cpu.max. cgroup v1 writes the
+// quota as is, while cgroup v2 writes "max" for any quota that is not
+// positive. A period of 0 means unset: cgroup v1 keeps the current
+// period and cgroup v2 writes the default of 100000, so a period of 0
+// is never written. A quota larger than the period is valid. Neither
+// validates the values against the kernel boundaries, so out of range
+// values are written as they are and only rejected by the kernel.
+func FuzzContainerLinuxCpuQuota(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var quota int64
+	if i < len(cpuQuotaValues) {
+		quota = cpuQuotaValues[i]
+	} else {
+		v := struct{ Quota int64 }{}
+		if err := c.GenerateStruct(&v); err != nil {
+			return -1
+		}
+		quota = v.Quota
+	}
+	i, err = c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var period uint64
+	if i < len(cpuPeriodValues) {
+		period = cpuPeriodValues[i]
+	} else {
+		v := struct{ Period uint64 }{}
+		if err := c.GenerateStruct(&v); err != nil {
+			return -1
+		}
+		period = v.Period
+	}
+	r := &configs.Resources{CpuQuota: quota, CpuPeriod: period}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-cpu-quota")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	v1Dir := filepath.Join(dir, "v1")
+	v2Dir := filepath.Join(dir, "v2")
+	if err := os.Mkdir(v1Dir, 0o755); err != nil {
+		return -1
+	}
+	if err := os.Mkdir(v2Dir, 0o755); err != nil {
+		return -1
+	}
+
+	v1Err := (&fs.CpuGroup{}).Set(v1Dir, r)
+	v2Err := setCpu(v2Dir, r)
+	if v1Err != nil || v2Err != nil {
+		return 0
+	}
+
+	got, err := cgroups.ReadFile(v1Dir, "cpu.cfs_quota_us")
+	if quota == 0 {
+		if err == nil {
+			panic(fmt.Sprintf("cpu.cfs_quota_us %q written for unset quota", got))
+		}
+	} else if err != nil || got != strconv.FormatInt(quota, 10) {
+		panic(fmt.Sprintf("quota %d was written as %q: %v", quota, got, err))
+	}
+	got, err = cgroups.ReadFile(v1Dir, "cpu.cfs_period_us")
+	if period == 0 {
+		if err == nil {
+			panic(fmt.Sprintf("cpu.cfs_period_us %q written for unset period", got))
+		}
+	} else if err != nil || got != strconv.FormatUint(period, 10) {
+		panic(fmt.Sprintf("period %d was written as %q: %v", period, got, err))
+	}
+
+	got, err = cgroups.ReadFile(v2Dir, "cpu.max")
+	if quota == 0 && period == 0 {
+		if err == nil {
+			panic(fmt.Sprintf("cpu.max %q written for unset quota and period", got))
+		}
+		return 0
+	}
+	expected := "max"
+	if quota > 0 {
+		expected = strconv.FormatInt(quota, 10)
+	}
+	if period == 0 {
+		expected += " 100000"
+	} else {
+		expected += " " + strconv.FormatUint(period, 10)
+	}
+	if err != nil || got != expected {
+		panic(fmt.Sprintf("quota %d with period %d: expected cpu.max %q, got %q: %v", quota, period, expected, got, err))
+	}
+	return 1
+}
+
+// ioMaxKeys are the io.max keys of the blkio throttle
+// fields, in the order setIo writes them.
+var ioMaxKeys = []string{"rbps", "wbps", "riops", "wiops"}
+
+var ioMaxLineRegex = regexp.MustCompile(`^-?[0-9]+:-?[0-9]+ (rbps|wbps|riops|wiops)=([0-9]+)$`)
+
+// FuzzContainerLinuxIoMax writes blkio throttle devices to io.max, one
+// line per device and field, formatted by ThrottleDevice.StringName. A
+// rate of 0 means no limit in the OCI spec and in cgroup v1, but it is
+// written as is, which io.max takes as a limit of 0; no limit would be
+// "max". Device numbers are not validated and left to the kernel.
+func FuzzContainerLinuxIoMax(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-io-max")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	for {
+		k, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		v := struct {
+			Major int64
+			Minor int64
+			Rate  uint64
+		}{}
+		if err := c.GenerateStruct(&v); err != nil {
+			break
+		}
+		td := configs.NewThrottleDevice(v.Major, v.Minor, v.Rate)
+		r := &configs.Resources{}
+		key := ioMaxKeys[k%len(ioMaxKeys)]
+		switch key {
+		case "rbps":
+			r.BlkioThrottleReadBpsDevice = []*configs.ThrottleDevice{td}
+		case "wbps":
+			r.BlkioThrottleWriteBpsDevice = []*configs.ThrottleDevice{td}
+		case "riops":
+			r.BlkioThrottleReadIOPSDevice = []*configs.ThrottleDevice{td}
+		case "wiops":
+			r.BlkioThrottleWriteIOPSDevice = []*configs.ThrottleDevice{td}
+		}
+		n++
+
+		if err := setIo(dir, r); err != nil {
+			panic(fmt.Sprintf("failed to write %s of %d:%d: %v", key, v.Major, v.Minor, err))
+		}
+		line, err := cgroups.ReadFile(dir, "io.max")
+		if err != nil {
+			return -1
+		}
+		if line != td.StringName(key) {
+			panic(fmt.Sprintf("%s of %d:%d with rate %d was written as %q", key, v.Major, v.Minor, v.Rate, line))
+		}
+		m := ioMaxLineRegex.FindStringSubmatch(line)
+		if m == nil || m[1] != key || m[2] != strconv.FormatUint(v.Rate, 10) {
+			panic(fmt.Sprintf("malformed io.max line %q for %s of %d:%d", line, key, v.Major, v.Minor))
+		}
+	}
+	if n == 0 {
+		return -1
+	}
+	return 1
+}
+
+// ioLatencyTargets are io.latency targets in microseconds,
+// where 0 disables latency control for the device.
+var ioLatencyTargets = []string{"0", "1", "10000", "18446744073709551615", "18446744073709551616", "-1", "max"}
+
+// FuzzContainerLinuxCgroupV2IoLatency sets io.latency through the
+// unified resources, which is the only way runc supports it. runc does
+// not parse the value: it is written in a single write, so all devices
+// end up in one value. Without the io controller, the file is missing
+// and the error has to say so.
+func FuzzContainerLinuxCgroupV2IoLatency(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	available, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	var lines []string
+	for {
+		v := struct{ Major, Minor uint16 }{}
+		if err := c.GenerateStruct(&v); err != nil {
+			break
+		}
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		target := ioLatencyTargets[i%len(ioLatencyTargets)]
+		line := fmt.Sprintf("%d:%d target=%s", v.Major, v.Minor, target)
+		if i >= len(ioLatencyTargets) {
+			line += " WRITE"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return -1
+	}
+	value := strings.Join(lines, "\n")
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-io-latency")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	controllers := "cpu memory pids"
+	if available {
+		controllers += " io"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte(controllers), 0o644); err != nil {
+		return -1
+	}
+	m := &manager{
+		config:  &configs.Cgroup{Resources: &configs.Resources{}},
+		dirPath: dir,
+	}
+	if err := m.getControllers(); err != nil {
+		return -1
+	}
+	if !available {
+		// The mock would create the missing file:
+		m.dirPath = filepath.Join(dir, "missing")
+	}
+
+	err = m.setUnified(map[string]string{"io.latency": value})
+	if !available {
+		if err == nil || !strings.Contains(err.Error(), `controller "io" not available`) {
+			panic(fmt.Sprintf("io.latency was set without the io controller: %v", err))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to set io.latency to %q: %v", value, err))
+	}
+	got, err := cgroups.ReadFile(dir, "io.latency")
+	if err != nil || got != value {
+		panic(fmt.Sprintf("io.latency %q was written as %q: %v", value, got, err))
+	}
+	return 1
+}
+
+// psiPrefixes and psiFields are the parts of a line of a PSI file
+// such as io.pressure, along with prefixes the kernel never writes.
+var (
+	psiPrefixes = []string{"some", "full", "SOME", "partial", ""}
+	psiFields   = []string{"avg10", "avg60", "avg300", "total"}
+	psiValues   = []string{"0.00", "12.34", "100.00", "100.01", "-1.00", "1e3", "NaN", "18446744073709551615", "18446744073709551616", "", "="}
+)
+
+// FuzzContainerLinuxCgroupV2IoPressure reads a fuzzed io.pressure file.
+// This version of runc has no PSI fields in its stats and no PSI parser:
+// the only code a PSI file can reach is the reader of flat keyed files
+// that is also used for io.stat. It keeps the fields of the last line
+// with each key as they are and drops lines without fields, so nothing
+// is validated. The io stats must not change because of the file.
+func FuzzContainerLinuxCgroupV2IoPressure(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var lines []string
+	for {
+		p, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		line := psiPrefixes[p%len(psiPrefixes)]
+		n, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		// Fields may be missing, repeated or out of order:
+		for i := 0; i < n%6; i++ {
+			f, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			v, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			value := psiValues[v%len(psiValues)]
+			if v >= len(psiValues) {
+				if value, err = c.GetString(); err != nil {
+					break
+				}
+			}
+			line += " " + psiFields[f%len(psiFields)] + "=" + value
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return -1
+	}
+	content := strings.Join(lines, "\n") + "\n"
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-io-pressure")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	const ioStat = "8:0 rbytes=1 wbytes=2 rios=3 wios=4\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "io.stat"), []byte(ioStat), 0o644); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "io.pressure"), []byte(content), 0o644); err != nil {
+		return -1
+	}
+
+	values, err := readCgroup2MapFile(dir, "io.pressure")
+	if err != nil {
+		panic(fmt.Sprintf("failed to read io.pressure %q: %v", content, err))
+	}
+	expected := make(map[string][]string)
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		expected[parts[0]] = parts[1:]
+	}
+	if len(values) != len(expected) {
+		panic(fmt.Sprintf("io.pressure %q was read as %q", content, values))
+	}
+	for k, v := range expected {
+		if strings.Join(values[k], " ") != strings.Join(v, " ") {
+			panic(fmt.Sprintf("%q in io.pressure %q was read as %q", k, content, values[k]))
+		}
+	}
+
+	var stats cgroups.Stats
+	if err := statIo(dir, &stats); err != nil {
+		panic(fmt.Sprintf("failed to read io.stat next to io.pressure %q: %v", content, err))
+	}
+	if len(stats.BlkioStats.IoServiceBytesRecursive) != 2 || len(stats.BlkioStats.IoServicedRecursive) != 2 {
+		panic(fmt.Sprintf("io.pressure %q changed the io stats: %+v", content, stats.BlkioStats))
+	}
+	return 1
+}
+
+// maxUsageUsec is the largest usage in microseconds that can be
+// converted to nanoseconds, about 584 years of CPU time, which is
+// more than the kernel can account.
+const maxUsageUsec = math.MaxUint64 / 1000
+
+// FuzzContainerLinuxCpuUsageDelta reads two snapshots of cpu.stat, as
+// consumers of runc events do to compute the CPU usage between them.
+// runc itself has no percentage: it reports counters, converted from
+// microseconds to nanoseconds, so the difference between two snapshots
+// has to be the difference of the counters in nanoseconds, and a
+// counter that went back, because the cgroup was recreated, has to go
+// back in the stats too.
+func FuzzContainerLinuxCpuUsageDelta(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var counters [2]uint64
+	for i := range counters {
+		v, err := c.GetUint64()
+		if err != nil {
+			return -1
+		}
+		counters[i] = v % (maxUsageUsec + 1)
+	}
+	usage, second := counters[0], counters[1]
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-cpu-usage")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	var snapshots [2]cgroups.Stats
+	for i, usage := range []uint64{usage, second} {
+		content := fmt.Sprintf("usage_usec %d\nuser_usec %d\nsystem_usec %d\n", usage, usage/2, usage-usage/2)
+		if err := ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte(content), 0o644); err != nil {
+			return -1
+		}
+		if err := statCpu(dir, &snapshots[i]); err != nil {
+			panic(fmt.Sprintf("failed to read cpu.stat %q: %v", content, err))
+		}
+		u := snapshots[i].CpuStats.CpuUsage
+		if u.TotalUsage != usage*1000 || u.UsageInUsermode != usage/2*1000 || u.UsageInKernelmode != (usage-usage/2)*1000 {
+			panic(fmt.Sprintf("cpu.stat %q was read as %+v", content, u))
+		}
+	}
+
+	prev := snapshots[0].CpuStats.CpuUsage.TotalUsage
+	cur := snapshots[1].CpuStats.CpuUsage.TotalUsage
+	if (cur < prev) != (second < usage) {
+		panic(fmt.Sprintf("usage from %d to %d usec was read as %d to %d ns", usage, second, prev, cur))
+	}
+	if second >= usage && cur-prev != (second-usage)*1000 {
+		panic(fmt.Sprintf("usage from %d to %d usec grew by %d ns", usage, second, cur-prev))
+	}
+	return 1
+}
+
+// cpuRtPeriods and cpuRtRuntimes are real-time bandwidth values. A
+// runtime of -1 is unlimited, which a child cgroup can never have.
+var (
+	cpuRtPeriods  = []uint64{0, 1, 1000, 10000, 100000, 1000000, 2000000}
+	cpuRtRuntimes = []int64{0, -1, 1, 1000, 10000, 100000, 950000, 1000000, 2000000}
+)
+
+// FuzzContainerLinuxWithCpuBandwidth sets the CFS and the real-time
+// bandwidth of a container together, using the CFS boundaries above,
+// on a fake cgroup v1 cpu controller and a fake cgroup v2 cgroup. On
+// cgroup v1 every value that is set is written as is, and validating
+// them, such as a real-time runtime longer than its period, is left to
+// the kernel. On cgroup v2 there is no real-time bandwidth, and setCpu
+// silently ignores CpuRtPeriod and CpuRtRuntime, so only cpu.max is
+// written.
+func FuzzContainerLinuxWithCpuBandwidth(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var idx [4]int
+	for i := range idx {
+		n, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		idx[i] = n
+	}
+	fullCPU, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	r := &configs.Resources{
+		CpuPeriod:    cpuPeriodValues[idx[0]%len(cpuPeriodValues)],
+		CpuQuota:     cpuQuotaValues[idx[1]%len(cpuQuotaValues)],
+		CpuRtPeriod:  cpuRtPeriods[idx[2]%len(cpuRtPeriods)],
+		CpuRtRuntime: cpuRtRuntimes[idx[3]%len(cpuRtRuntimes)],
+		SkipDevices:  true,
+	}
+	if fullCPU && r.CpuPeriod <= math.MaxInt64 {
+		r.CpuQuota = int64(r.CpuPeriod)
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-cpu")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	v1Dir := filepath.Join(dir, "v1")
+	v2Dir := filepath.Join(dir, "v2")
+	if err := os.Mkdir(v1Dir, 0o755); err != nil {
+		return -1
+	}
+	if err := os.Mkdir(v2Dir, 0o755); err != nil {
+		return -1
+	}
+
+	if err := (&fs.CpuGroup{}).Set(v1Dir, r); err != nil {
+		panic(fmt.Sprintf("failed to set %+v on cgroup v1: %v", r, err))
+	}
+	expected := map[string]string{}
+	if r.CpuPeriod != 0 {
+		expected["cpu.cfs_period_us"] = strconv.FormatUint(r.CpuPeriod, 10)
+	}
+	if r.CpuQuota != 0 {
+		expected["cpu.cfs_quota_us"] = strconv.FormatInt(r.CpuQuota, 10)
+	}
+	if r.CpuRtPeriod != 0 {
+		expected["cpu.rt_period_us"] = strconv.FormatUint(r.CpuRtPeriod, 10)
+	}
+	if r.CpuRtRuntime != 0 {
+		expected["cpu.rt_runtime_us"] = strconv.FormatInt(r.CpuRtRuntime, 10)
+	}
+	files, err := ioutil.ReadDir(v1Dir)
+	if err != nil {
+		return -1
+	}
+	if len(files) != len(expected) {
+		panic(fmt.Sprintf("%+v wrote %d files on cgroup v1, expected %v", r, len(files), expected))
+	}
+	for file, val := range expected {
+		if got, err := cgroups.ReadFile(v1Dir, file); err != nil || got != val {
+			panic(fmt.Sprintf("%s: expected %q, got %q: %v", file, val, got, err))
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(v2Dir, "cgroup.controllers"), []byte("cpu\n"), 0o644); err != nil {
+		return -1
+	}
+	m, err := NewManager(&configs.Cgroup{Resources: r}, v2Dir, false)
+	if err != nil {
+		return -1
+	}
+	if err := m.Set(r); err != nil {
+		return 0
+	}
+	for _, file := range []string{"cpu.rt_period_us", "cpu.rt_runtime_us"} {
+		if _, err := os.Stat(filepath.Join(v2Dir, file)); err == nil {
+			panic(fmt.Sprintf("%s written on cgroup v2", file))
+		}
+	}
+	if r.CpuQuota != 0 || r.CpuPeriod != 0 {
+		if _, err := cgroups.ReadFile(v2Dir, "cpu.max"); err != nil {
+			panic(fmt.Sprintf("cpu.max was not written for %+v: %v", r, err))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,923 @@
+// +build gofuzz
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/cgroups/fscommon"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/devices"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// boundaryValues are the values the kernel treats specially for at
+// least one of the resource fields.
+var boundaryValues = []int64{
+	0,
+	-1,
+	1,
+	-2,
+	9,
+	10,
+	1000,
+	1001,
+	32768,
+	4194304, // PID_MAX_LIMIT
+	4194305,
+	math.MaxInt64,
+	math.MaxInt64 - 1,
+	9223372036854771712, // unlimited memory, page aligned
+	math.MinInt64,
+}
+
+// getBoundaryValue returns either one of boundaryValues
+// or a fuzzed value.
+func getBoundaryValue(c *gofuzzheaders.ConsumeFuzzer) (int64, error) {
+	i, err := c.GetInt()
+	if err != nil {
+		return 0, err
+	}
+	if i < len(boundaryValues) {
+		return boundaryValues[i], nil
+	}
+	v := struct{ V int64 }{}
+	if err := c.GenerateStruct(&v); err != nil {
+		return 0, err
+	}
+	return v.V, nil
+}
+
+func FuzzCgroupResourcesMaxValues(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	var values [6]int64
+	for i := range values {
+		v, err := getBoundaryValue(c)
+		if err != nil {
+			return -1
+		}
+		values[i] = v
+	}
+	r := &configs.Resources{
+		Memory:      values[0],
+		CpuQuota:    values[1],
+		CpuPeriod:   uint64(values[2]),
+		CpuShares:   uint64(values[3]),
+		BlkioWeight: uint16(values[4]),
+		PidsLimit:   values[5],
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-resources")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	// Make sure the legacy blkio weight file is detected:
+	if err := ioutil.WriteFile(filepath.Join(dir, "blkio.weight"), []byte("500\n"), 0o644); err != nil {
+		return -1
+	}
+
+	memory := &MemoryGroup{}
+	if err := memory.Set(dir, r); err != nil {
+		return 0
+	}
+	cpu := &CpuGroup{}
+	if err := cpu.Set(dir, r); err != nil {
+		return 0
+	}
+	blkio := &BlkioGroup{}
+	if err := blkio.Set(dir, r); err != nil {
+		return 0
+	}
+	pids := &PidsGroup{}
+	if err := pids.Set(dir, r); err != nil {
+		return 0
+	}
+
+	// Read every value back. Negative limits are
+	// read as 0 and "max" as math.MaxUint64.
+	checkUint := func(file string, set bool, expected uint64) {
+		if !set {
+			return
+		}
+		got, err := fscommon.GetCgroupParamUint(dir, file)
+		if err != nil {
+			panic(fmt.Sprintf("failed to read back %s: %v", file, err))
+		}
+		if got != expected {
+			panic(fmt.Sprintf("%s: wrote %d, read back %d", file, expected, got))
+		}
+	}
+	toUint := func(v int64) uint64 {
+		if v < 0 {
+			return 0
+		}
+		return uint64(v)
+	}
+	checkUint("memory.limit_in_bytes", r.Memory != 0, toUint(r.Memory))
+	checkUint("cpu.cfs_period_us", r.CpuPeriod != 0, r.CpuPeriod)
+	checkUint("cpu.shares", r.CpuShares != 0, r.CpuShares)
+	checkUint("blkio.weight", r.BlkioWeight != 0, uint64(r.BlkioWeight))
+	pidsMax := uint64(math.MaxUint64)
+	if r.PidsLimit > 0 {
+		pidsMax = uint64(r.PidsLimit)
+	}
+	checkUint("pids.max", r.PidsLimit != 0, pidsMax)
+
+	if r.CpuQuota != 0 {
+		quota, err := fscommon.GetCgroupParamInt(dir, "cpu.cfs_quota_us")
+		if err != nil {
+			panic(fmt.Sprintf("failed to read back cpu.cfs_quota_us: %v", err))
+		}
+		if quota != r.CpuQuota {
+			panic(fmt.Sprintf("cpu.cfs_quota_us: wrote %d, read back %d", r.CpuQuota, quota))
+		}
+	}
+	return 1
+}
+
+func FuzzCgroupFreezerState(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	state, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	selfMode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	self, err := c.GetString()
+	if err != nil {
+		self = ""
+	}
+	switch selfMode % 4 {
+	case 0:
+		self = ""
+	case 1:
+		self = "0\n"
+	case 2:
+		self = "1\n"
+	}
+	// A cgroup that is FREEZING is waited on until it changes
+	// state, which never happens with a mock freezer.state:
+	if strings.TrimSpace(state) == "FREEZING" {
+		return 0
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-freezer")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "freezer.state"), []byte(state), 0o644); err != nil {
+		return -1
+	}
+	if self != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "freezer.self_freezing"), []byte(self), 0o644); err != nil {
+			return -1
+		}
+	}
+
+	freezer := &FreezerGroup{}
+	got, err := freezer.GetState(dir)
+
+	expected := configs.Undefined
+	switch strings.TrimSpace(state) {
+	case "THAWED":
+		expected = configs.Thawed
+	case "FROZEN":
+		// Without freezer.self_freezing the cgroup is
+		// considered to be frozen:
+		switch self {
+		case "", "1\n":
+			expected = configs.Frozen
+		case "0\n":
+			expected = configs.Thawed
+		}
+	}
+	if expected == configs.Undefined {
+		// Anything else, including lowercase states,
+		// must be an error and not a valid state:
+		if err == nil || got != configs.Undefined {
+			panic(fmt.Sprintf("invalid state %q (self_freezing %q) returned %q, %v", state, self, got, err))
+		}
+		return 0
+	}
+	if err != nil || got != expected {
+		panic(fmt.Sprintf("state %q (self_freezing %q): expected %q, got %q, %v", state, self, expected, got, err))
+	}
+	return 1
+}
+
+// ifPrioNames are interface names for net_prio, including names of
+// IFNAMSIZ (16) bytes and more, and names the kernel does not allow.
+var ifPrioNames = []string{"lo", "eth0", "veth1234567890ab", "veth1234567890a", "", ".", "..", "eth 0", "eth0\n", "eth/0"}
+
+// FuzzContainerLinuxNetPrio sets the interface priorities of the
+// net_prio controller. Each entry is written separately, so only
+// the last one is left in the mock net_prio.ifpriomap. runc does not
+// validate the interface names or priorities, and leaves rejecting
+// them to the kernel, so every entry is written as "<iface> <prio>".
+func FuzzContainerLinuxNetPrio(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var prioMap []*configs.IfPrioMap
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		prio, err := getBoundaryValue(c)
+		if err != nil {
+			break
+		}
+		name := ifPrioNames[i%len(ifPrioNames)]
+		if i >= len(ifPrioNames) {
+			name, err = c.GetString()
+			if err != nil {
+				break
+			}
+		}
+		prioMap = append(prioMap, &configs.IfPrioMap{Interface: name, Priority: prio})
+	}
+	if len(prioMap) == 0 {
+		return -1
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-net-prio")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "net_prio.ifpriomap"), nil, 0o644); err != nil {
+		return -1
+	}
+
+	var entries []string
+	for _, m := range prioMap {
+		entries = append(entries, m.CgroupString())
+	}
+	if err := (&NetPrioGroup{}).Set(dir, &configs.Resources{NetPrioIfpriomap: prioMap}); err != nil {
+		panic(fmt.Sprintf("failed to set interface priorities %q: %v", entries, err))
+	}
+
+	// A priority of 0 is written as well: it resets the
+	// interface to the default priority.
+	last := prioMap[len(prioMap)-1]
+	written, err := cgroups.ReadFile(dir, "net_prio.ifpriomap")
+	if err != nil {
+		return -1
+	}
+	if expected := last.Interface + " " + strconv.FormatInt(last.Priority, 10); written != expected {
+		panic(fmt.Sprintf("%+v was written as %q, expected %q", *last, written, expected))
+	}
+	return 1
+}
+
+// FuzzContainerLinuxNetCls sets the net_cls classid over whatever the
+// mock net_cls.classid contains. runc writes the classid in decimal,
+// which the kernel accepts as well as the 0xAAAABBBB notation, and
+// does not write a classid of 0, leaving the inherited one in place.
+func FuzzContainerLinuxNetCls(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	v := struct{ Classid uint32 }{}
+	if err := c.GenerateStruct(&v); err != nil {
+		return -1
+	}
+	existing, err := c.GetString()
+	if err != nil {
+		existing = "0\n"
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-net-cls")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "net_cls.classid"), []byte(existing), 0o644); err != nil {
+		return -1
+	}
+	// Reading garbage must fail, not panic:
+	_, _ = fscommon.GetCgroupParamUint(dir, "net_cls.classid")
+
+	if err := (&NetClsGroup{}).Set(dir, &configs.Resources{NetClsClassid: v.Classid}); err != nil {
+		panic(fmt.Sprintf("failed to set classid %#08x: %v", v.Classid, err))
+	}
+	written, err := cgroups.ReadFile(dir, "net_cls.classid")
+	if err != nil {
+		return -1
+	}
+	if v.Classid == 0 {
+		if written != existing {
+			panic(fmt.Sprintf("classid 0 overwrote %q with %q", existing, written))
+		}
+		return 0
+	}
+	if written != strconv.FormatUint(uint64(v.Classid), 10) {
+		panic(fmt.Sprintf("classid %#08x was written as %q", v.Classid, written))
+	}
+	classid, err := fscommon.GetCgroupParamUint(dir, "net_cls.classid")
+	if err != nil || classid != uint64(v.Classid) {
+		panic(fmt.Sprintf("classid %#08x was read back as %#x: %v", v.Classid, classid, err))
+	}
+	return 1
+}
+
+// devicePermissions are permissions of a device rule, including ones
+// that are not a subset of "rwm" in that order.
+var devicePermissions = []devices.Permissions{"", "r", "w", "m", "rw", "rwm", "RWM", "rwr", "x", "mwr", "rw ", "rwmrwm"}
+
+// FuzzContainerLinuxDevicePermissions allows a single device in a
+// deny-all devices cgroup and reads the rule back from devices.list,
+// the way the kernel lists it.
+func FuzzContainerLinuxDevicePermissions(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var perms devices.Permissions
+	if i < len(devicePermissions) {
+		perms = devicePermissions[i]
+	} else {
+		p, err := c.GetString()
+		if err != nil {
+			return -1
+		}
+		perms = devices.Permissions(p)
+	}
+	rule := &devices.Rule{
+		Type:        devices.CharDevice,
+		Major:       1,
+		Minor:       3,
+		Permissions: perms,
+		Allow:       true,
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-device-permissions")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	// A new devices cgroup allows everything:
+	if err := ioutil.WriteFile(filepath.Join(dir, "devices.list"), []byte("a *:* rwm\n"), 0o644); err != nil {
+		return -1
+	}
+
+	r := &configs.Resources{
+		Devices: []*devices.Rule{
+			{Type: devices.WildcardDevice, Major: devices.Wildcard, Minor: devices.Wildcard, Permissions: "rwm", Allow: false},
+			rule,
+		},
+	}
+	// devices.list cannot be mocked to follow the writes:
+	err = (&DevicesGroup{testingSkipFinalCheck: true}).Set(dir, r)
+	allowed, readErr := cgroups.ReadFile(dir, "devices.allow")
+	// The emulator normalizes the permissions: unknown characters
+	// and duplicates are dropped, and the rest is put in "rwm" order.
+	normalized := perms.Union("")
+	if normalized.IsEmpty() {
+		if err == nil && readErr == nil {
+			panic(fmt.Sprintf("permissions %q without any access were written as %q", perms, allowed))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to allow %q: %v", rule.CgroupString(), err))
+	}
+	if expected := "c 1:3 " + string(normalized); readErr != nil || allowed != expected {
+		panic(fmt.Sprintf("rule %q was written as %q, expected %q: %v", rule.CgroupString(), allowed, expected, readErr))
+	}
+
+	// The kernel lists the allowed device as it was written:
+	if err := ioutil.WriteFile(filepath.Join(dir, "devices.list"), []byte(allowed+"\n"), 0o644); err != nil {
+		return -1
+	}
+	emu, err := loadEmulator(dir)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse devices.list %q: %v", allowed, err))
+	}
+	rules, err := emu.Rules()
+	if err != nil || len(rules) != 1 || rules[0].CgroupString() != allowed {
+		panic(fmt.Sprintf("devices.list %q was read back as %+v: %v", allowed, rules, err))
+	}
+	return 1
+}
+
+// cgroupPathSegments are path segments for a cgroup path,
+// including ones that try to leave the cgroup hierarchy.
+var cgroupPathSegments = []string{"", ".", "..", "/", "//", "fuzz", "user.slice", "../../..", "memory", "cpu,cpuacct"}
+
+// FuzzContainerLinuxCgroupPath computes the paths of a container's
+// cgroups from the Path of its config. An absolute path is below the
+// mount of each subsystem and a relative one below the cgroup runc
+// itself is in. In both cases ".." is cleaned away lexically instead
+// of being rejected, and the result must never leave that directory.
+// An empty Path puts the container in runc's own cgroup. The systemd
+// manager ignores Path and uses the Parent and Name that specconv
+// fills in from "slice:prefix:name", so there is nothing to compare
+// it with here.
+func FuzzContainerLinuxCgroupPath(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	withName, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	path := ""
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		s := cgroupPathSegments[i%len(cgroupPathSegments)]
+		if i >= len(cgroupPathSegments) {
+			if s, err = c.GetString(); err != nil {
+				break
+			}
+		}
+		if i%2 == 0 {
+			path += "/"
+		}
+		path += s
+	}
+
+	config := &configs.Cgroup{Path: path, Resources: &configs.Resources{}}
+	if withName {
+		config.Name = "fuzz"
+	}
+	d, err := getCgroupData(config, 0)
+	if withName && path != "" {
+		if err == nil {
+			panic(fmt.Sprintf("both Path %q and Name were accepted", path))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+	if withName {
+		// Without a Path, the Name is used the same way:
+		path = config.Name
+	}
+
+	for _, sys := range subsystems {
+		name := sys.Name()
+		p, err := d.path(name)
+		if err != nil {
+			continue
+		}
+		var base string
+		if filepath.IsAbs(path) {
+			mnt, err := cgroups.FindCgroupMountpoint(d.root, name)
+			if err != nil {
+				panic(fmt.Sprintf("%s: mountpoint not found after path %q: %v", name, p, err))
+			}
+			base = filepath.Join(d.root, filepath.Base(mnt))
+		} else {
+			base, err = cgroups.GetOwnCgroupPath(name)
+			if err != nil {
+				panic(fmt.Sprintf("%s: own cgroup not found after path %q: %v", name, p, err))
+			}
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			panic(fmt.Sprintf("%s: cgroup path %q became %q, outside of %q", name, path, p, base))
+		}
+		if path == "" && p != base {
+			panic(fmt.Sprintf("%s: empty cgroup path became %q instead of %q", name, p, base))
+		}
+		if p != filepath.Join(base, filepath.Clean("/"+path)) {
+			panic(fmt.Sprintf("%s: cgroup path %q became %q below %q", name, path, p, base))
+		}
+	}
+	return 1
+}
+
+// memoryStatKeys are memory.stat keys of cgroup v1, both the counters
+// of the cgroup itself and the total_ ones of the whole hierarchy
+// below it.
+var memoryStatKeys = []string{
+	"cache", "rss", "rss_huge", "mapped_file", "swap", "pgfault",
+	"total_cache", "total_rss", "total_rss_huge", "total_mapped_file", "total_swap", "total_pgfault",
+	"hierarchical_memory_limit",
+}
+
+// FuzzCgroupStatMemoryHierarchy reads a memory.stat with only the
+// counters of the cgroup itself, only the total_ ones, or both. Every
+// key is kept as is in Stats, a repeated key replaces the earlier
+// value instead of being added to it, and Cache is always the "cache"
+// of the cgroup itself: it is not filled in from total_cache when that
+// is all there is. The usage comes from memory.usage_in_bytes and not
+// from adding up the counters.
+func FuzzCgroupStatMemoryHierarchy(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	useHierarchy, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	v := struct{ Usage uint64 }{}
+	if err := c.GenerateStruct(&v); err != nil {
+		return -1
+	}
+	expected := map[string]uint64{}
+	var content strings.Builder
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		key := memoryStatKeys[i%len(memoryStatKeys)]
+		total := strings.HasPrefix(key, "total_")
+		if (mode%3 == 0 && total) || (mode%3 == 1 && !total) {
+			continue
+		}
+		val := struct{ Value uint64 }{}
+		if err := c.GenerateStruct(&val); err != nil {
+			break
+		}
+		fmt.Fprintf(&content, "%s %d\n", key, val.Value)
+		expected[key] = val.Value
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-memory-stat")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	hierarchy := "0"
+	if useHierarchy {
+		hierarchy = "1"
+	}
+	files := map[string]string{
+		"memory.stat":               content.String(),
+		"memory.usage_in_bytes":     strconv.FormatUint(v.Usage, 10) + "\n",
+		"memory.max_usage_in_bytes": strconv.FormatUint(v.Usage, 10) + "\n",
+		"memory.failcnt":            "0\n",
+		"memory.limit_in_bytes":     "9223372036854771712\n",
+		"memory.use_hierarchy":      hierarchy + "\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			return -1
+		}
+	}
+
+	stats := cgroups.NewStats()
+	if err := (&MemoryGroup{}).GetStats(dir, stats); err != nil {
+		panic(fmt.Sprintf("failed to get stats from %q: %v", content.String(), err))
+	}
+	m := stats.MemoryStats
+	if len(m.Stats) != len(expected) {
+		panic(fmt.Sprintf("memory.stat %q: expected %v, got %v", content.String(), expected, m.Stats))
+	}
+	for key, val := range expected {
+		if got, ok := m.Stats[key]; !ok || got != val {
+			panic(fmt.Sprintf("memory.stat %q: expected %s %d, got %d", content.String(), key, val, got))
+		}
+	}
+	if m.Cache != expected["cache"] {
+		panic(fmt.Sprintf("memory.stat %q: expected cache %d, got %d", content.String(), expected["cache"], m.Cache))
+	}
+	if m.Usage.Usage != v.Usage {
+		panic(fmt.Sprintf("memory.stat %q: expected usage %d, got %d", content.String(), v.Usage, m.Usage.Usage))
+	}
+	if m.UseHierarchy != useHierarchy {
+		panic(fmt.Sprintf("use_hierarchy %s became %v", hierarchy, m.UseHierarchy))
+	}
+	return 1
+}
+
+// freezerStates are what the kernel may report in freezer.state.
+var freezerStates = []string{"FREEZING\n", "FROZEN\n", "THAWED\n", "FREEZING", "frozen\n", "\n", "FREEZING\nFROZEN\n"}
+
+// freezerOps is what was done with a freezer.state fifo.
+type freezerOps struct {
+	writes []string
+	reads  int
+}
+
+// serveFreezerState plays the kernel side of a freezer.state fifo until
+// done is closed: every write is recorded and every read is answered
+// with the next of states, the last of which sticks. A write of FROZEN
+// is followed by a read, Set reads nothing after thawing and GetState
+// does nothing but read. Every open waits until runc closed the fifo,
+// so that it can not get the data of the next read or write as well.
+func serveFreezerState(fifo string, states []string, readOnly bool, done <-chan struct{}) freezerOps {
+	var ops freezerOps
+	isOpen := func() bool {
+		d, err := os.Open("/proc/self/fd")
+		if err != nil {
+			return false
+		}
+		defer d.Close()
+		fds, _ := d.Readdirnames(-1)
+		for _, fd := range fds {
+			if p, _ := os.Readlink(filepath.Join("/proc/self/fd", fd)); p == fifo {
+				return true
+			}
+		}
+		return false
+	}
+	write := !readOnly
+	for {
+		for isOpen() {
+			time.Sleep(10 * time.Microsecond)
+		}
+		select {
+		case <-done:
+			return ops
+		default:
+		}
+		if write {
+			f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+			if err != nil {
+				return ops
+			}
+			data, _ := ioutil.ReadAll(f)
+			f.Close()
+			if len(data) == 0 {
+				// Only opened to unblock us.
+				continue
+			}
+			ops.writes = append(ops.writes, string(data))
+			write = string(data) != string(configs.Frozen)
+			continue
+		}
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return ops
+		}
+		select {
+		case <-done:
+			f.Close()
+			return ops
+		default:
+		}
+		i := ops.reads
+		if i >= len(states) {
+			i = len(states) - 1
+		}
+		_, _ = f.WriteString(states[i])
+		// runc may still be about to get its file descriptor
+		// of the fifo, so wait until it has read everything:
+		for {
+			n, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCINQ)
+			if err != nil || n == 0 {
+				break
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		f.Close()
+		ops.reads++
+		write = !readOnly
+	}
+}
+
+// FuzzCgroupFreezerStateMachine freezes, thaws or gets the state of a
+// cgroup whose freezer.state is a fifo, so that every read returns
+// the next of a fuzzed sequence of states. Freezing retries while the
+// cgroup is FREEZING, but gives up after 1000 reads, and thaws the
+// cgroup again whenever it fails. GetState also waits for FREEZING to
+// end, but without any bound, so a cgroup stuck in FREEZING makes it
+// loop forever.
+func FuzzCgroupFreezerStateMachine(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	states := []string{}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		n, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		for j := 0; j <= n*4; j++ {
+			states = append(states, freezerStates[i%len(freezerStates)])
+		}
+	}
+	if len(states) == 0 {
+		return -1
+	}
+	state := func(i int) string {
+		if i >= len(states) {
+			i = len(states) - 1
+		}
+		return strings.TrimSpace(states[i])
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-freezer-states")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "freezer.state")
+	if err := unix.Mkfifo(fifo, 0o600); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "freezer.self_freezing"), []byte("1\n"), 0o644); err != nil {
+		return -1
+	}
+
+	getState := mode%3 == 2
+	done := make(chan struct{})
+	opsCh := make(chan freezerOps, 1)
+	go func() {
+		opsCh <- serveFreezerState(fifo, states, getState, done)
+	}()
+	type result struct {
+		state configs.FreezerState
+		err   error
+	}
+	resCh := make(chan result, 1)
+	freezer := &FreezerGroup{}
+	go func() {
+		var res result
+		switch mode % 3 {
+		case 0:
+			res.err = freezer.Set(dir, &configs.Resources{Freezer: configs.Frozen})
+		case 1:
+			res.err = freezer.Set(dir, &configs.Resources{Freezer: configs.Thawed})
+		case 2:
+			res.state, res.err = freezer.GetState(dir)
+		}
+		resCh <- res
+	}()
+	var res result
+	select {
+	case res = <-resCh:
+	case <-time.After(10 * time.Second):
+		panic(fmt.Sprintf("freezer did not finish after 10 seconds with states %q", states))
+	}
+
+	// Unblock the fifo in case the kernel side is waiting for more:
+	close(done)
+	var ops freezerOps
+	for received := false; !received; {
+		if f, err := os.OpenFile(fifo, os.O_RDWR|unix.O_NONBLOCK, 0); err == nil {
+			f.Close()
+		}
+		select {
+		case ops = <-opsCh:
+			received = true
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	switch mode % 3 {
+	case 0:
+		reads, frozen := 0, false
+		for reads < 1000 {
+			s := state(reads)
+			reads++
+			if s != "FREEZING" {
+				frozen = s == "FROZEN"
+				break
+			}
+		}
+		if ops.reads != reads {
+			panic(fmt.Sprintf("freezing read %d states instead of %d: %q", ops.reads, reads, states))
+		}
+		for _, w := range ops.writes {
+			if w != string(configs.Frozen) && w != string(configs.Thawed) {
+				panic(fmt.Sprintf("freezing wrote %q", w))
+			}
+		}
+		if frozen {
+			if res.err != nil {
+				panic(fmt.Sprintf("freezing failed after %d reads: %v", reads, res.err))
+			}
+			return 1
+		}
+		if res.err == nil {
+			panic(fmt.Sprintf("freezing succeeded with states %q", states[:reads]))
+		}
+		if last := ops.writes[len(ops.writes)-1]; last != string(configs.Thawed) {
+			panic(fmt.Sprintf("cgroup was left %q after freezing failed: %v", last, res.err))
+		}
+	case 1:
+		if res.err != nil || ops.reads != 0 || !reflect.DeepEqual(ops.writes, []string{string(configs.Thawed)}) {
+			panic(fmt.Sprintf("thawing wrote %q and read %d states: %v", ops.writes, ops.reads, res.err))
+		}
+	case 2:
+		reads := 0
+		for state(reads) == "FREEZING" {
+			reads++
+		}
+		expected := configs.Undefined
+		switch state(reads) {
+		case "THAWED":
+			expected = configs.Thawed
+		case "FROZEN":
+			expected = configs.Frozen
+		}
+		if ops.reads != reads+1 || res.state != expected || (expected == configs.Undefined) != (res.err != nil) {
+			panic(fmt.Sprintf("states %q gave %q after %d reads: %v", states, res.state, ops.reads, res.err))
+		}
+	}
+	return 1
+}
+
+// FuzzCgroupV1v2Routing sets memory, cpu and pids limits through the
+// v1 manager on a host where some of the controllers are on a cgroup2
+// mount. The manager writes each limit to the hierarchy of its
+// controller, and never writes to the unified hierarchy, which is
+// only joined. Limits of controllers that are not on v1 are left
+// unset: runc fails to set them, but in TestMode the missing path
+// would make it write to the root directory instead.
+func FuzzCgroupV1v2Routing(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var limits struct {
+		OnV1   uint8
+		Memory uint32
+		Shares uint16
+		Pids   uint16
+	}
+	if err := c.GenerateStruct(&limits); err != nil {
+		return -1
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-v1v2-routing")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	paths := map[string]string{"": filepath.Join(dir, "unified", "fuzz")}
+	r := &configs.Resources{SkipDevices: true}
+	expected := make(map[string]string)
+	for i, name := range []string{"memory", "cpu", "pids"} {
+		if limits.OnV1&(1<<uint(i)) == 0 {
+			continue
+		}
+		paths[name] = filepath.Join(dir, name, "fuzz")
+		switch name {
+		case "memory":
+			r.Memory = int64(limits.Memory) + 1
+			expected[filepath.Join(paths[name], "memory.limit_in_bytes")] = strconv.FormatInt(r.Memory, 10)
+		case "cpu":
+			r.CpuShares = uint64(limits.Shares) + 2
+			expected[filepath.Join(paths[name], "cpu.shares")] = strconv.FormatUint(r.CpuShares, 10)
+		case "pids":
+			r.PidsLimit = int64(limits.Pids) + 1
+			expected[filepath.Join(paths[name], "pids.max")] = strconv.FormatInt(r.PidsLimit, 10)
+		}
+	}
+	for _, p := range paths {
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			return -1
+		}
+	}
+
+	m := NewManager(&configs.Cgroup{Resources: r}, paths, false)
+	if err := m.Set(r); err != nil {
+		panic(fmt.Sprintf("failed to set %+v: %v", *r, err))
+	}
+	for name, p := range paths {
+		if got := m.Path(name); got != p {
+			panic(fmt.Sprintf("%q hierarchy is at %q, expected %q", name, got, p))
+		}
+	}
+	for file, value := range expected {
+		got, err := ioutil.ReadFile(file)
+		if err != nil || string(got) != value {
+			panic(fmt.Sprintf("%s is %q, expected %q: %v", file, got, value, err))
+		}
+	}
+	written, err := ioutil.ReadDir(paths[""])
+	if err != nil {
+		return -1
+	}
+	if len(written) != 0 {
+		panic(fmt.Sprintf("%d files written to the unified hierarchy", len(written)))
+	}
+	return 1
+}
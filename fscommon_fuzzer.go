@@ -3,8 +3,15 @@
 package fscommon
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
 	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
 	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
 )
 
 func FuzzSecurejoin(data []byte) int {
@@ -22,4 +29,105 @@ func FuzzSecurejoin(data []byte) int {
 		return 0
 	}
 	return 1
-}
\ No newline at end of file
+}
+
+// fdinfoKeys, fdinfoSeparators and fdinfoValues make up lines of
+// /proc/<pid>/fdinfo/<fd> files, which separate keys and values with
+// ":\t", and of the cgroup files that use a single space.
+var (
+	fdinfoKeys       = []string{"pos", "flags", "mnt_id", "ino", "eventfd-count", "Seccomp", "flags:", ""}
+	fdinfoSeparators = []string{" ", ":\t", ": ", "\t", "  ", ""}
+	fdinfoValues     = []string{
+		"0", "1", "02000002", "0x1f", "1f", "-1", "", "12 34",
+		"18446744073709551615", "18446744073709551616", "-9223372036854775809",
+	}
+)
+
+// FuzzParseFdInfo reads a key from fdinfo-like content with
+// GetValueByKey(). runc does not read fdinfo itself, and its key-value
+// reader only knows the "key value" lines of cgroup files: a line with
+// any other separator never matches, and a key that is not found reads
+// as 0 without an error. Values are decimal, so octal flags are misread
+// and hex values are an error. Negative values read as 0, and values
+// that do not fit in a uint64 are an error. The first matching line
+// wins, however long the lines are.
+func FuzzParseFdInfo(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	k, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	key := fdinfoKeys[k%len(fdinfoKeys)]
+	var lines []string
+	for {
+		k, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		s, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		v, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		value := fdinfoValues[v%len(fdinfoValues)]
+		if v >= len(fdinfoValues) {
+			if value, err = c.GetString(); err != nil {
+				break
+			}
+		}
+		// Make some lines longer than a page:
+		if s >= len(fdinfoSeparators) {
+			value = strings.Repeat("0", s*32) + value
+		}
+		lines = append(lines, fdinfoKeys[k%len(fdinfoKeys)]+fdinfoSeparators[s%len(fdinfoSeparators)]+value)
+	}
+
+	cgroups.TestMode = true
+	dir, err := ioutil.TempDir("", "fuzz-fdinfo")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	content := strings.Join(lines, "\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "fdinfo"), []byte(content), 0o644); err != nil {
+		return -1
+	}
+
+	value, err := GetValueByKey(dir, "fdinfo", key)
+
+	found := false
+	var expected uint64
+	var expectedErr error
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(line, key+" ") {
+			continue
+		}
+		v := strings.TrimPrefix(line, key+" ")
+		if strings.Contains(v, " ") {
+			continue
+		}
+		found = true
+		expected, expectedErr = ParseUint(v, 10, 64)
+		break
+	}
+	switch {
+	case !found:
+		if err != nil || value != 0 {
+			panic(fmt.Sprintf("missing key %q was read as %d: %v", key, value, err))
+		}
+		return 0
+	case expectedErr != nil:
+		if err == nil {
+			panic(fmt.Sprintf("malformed value of %q was read as %d", key, value))
+		}
+		return 0
+	case err != nil:
+		panic(fmt.Sprintf("failed to read %q: %v", key, err))
+	case value != expected:
+		panic(fmt.Sprintf("%q was read as %d, expected %d", key, value, expected))
+	}
+	return 1
+}
@@ -3,11 +3,45 @@
 package libcontainer
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	criurpc "github.com/checkpoint-restore/go-criu/v5/rpc"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	cgroupdevices "github.com/opencontainers/runc/libcontainer/cgroups/devices"
+	"github.com/opencontainers/runc/libcontainer/cgroups/fs2"
 	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/configs/validate"
+	"github.com/opencontainers/runc/libcontainer/devices"
+	"github.com/opencontainers/runc/libcontainer/keys"
+	"github.com/opencontainers/runc/libcontainer/specconv"
+	"github.com/opencontainers/runc/libcontainer/system"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"github.com/opencontainers/runc/libcontainer/utils"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	selinux "github.com/opencontainers/selinux/go-selinux"
 	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func FuzzStateApi(data []byte) int {
@@ -94,3 +128,5001 @@ func newTestRoot() (string, error) {
 	}
 	return dir, nil
 }
+
+// createFuzzRootfs populates rootfs with fuzz-controlled
+// files, directories and symlinks. Paths are resolved with
+// SecureJoin, so the symlinks created earlier are followed
+// as if rootfs was the root and never lead to the host.
+func createFuzzRootfs(c *gofuzzheaders.ConsumeFuzzer, rootfs string) error {
+	for {
+		t, err := c.GetInt()
+		if err != nil {
+			return nil
+		}
+		name, err := c.GetString()
+		if err != nil {
+			return nil
+		}
+		name = filepath.Clean("/" + name)
+		dir, err := securejoin.SecureJoin(rootfs, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		// The symlink itself is created in dir, files and
+		// directories are created where the path leads to.
+		path := filepath.Join(dir, filepath.Base(name))
+		if t%3 != 2 {
+			if path, err = securejoin.SecureJoin(rootfs, name); err != nil {
+				return err
+			}
+		}
+		switch t % 3 {
+		case 0:
+			err = os.MkdirAll(path, 0o755)
+		case 1:
+			err = ioutil.WriteFile(path, []byte(name), 0o644)
+		case 2:
+			target, tErr := c.GetString()
+			if tErr != nil {
+				return nil
+			}
+			err = os.Symlink(target, path)
+		}
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+}
+
+func FuzzContainerPivotRoot(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	bindMount, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	privateMount, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	mountProc, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-pivot-root")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		return -1
+	}
+
+	// pivot_root has to happen in a separate mount namespace.
+	// The thread is locked and never unlocked, so the Go
+	// runtime throws it away once the goroutine exits.
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); err != nil {
+			errCh <- err
+			return
+		}
+		if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+			errCh <- err
+			return
+		}
+		if bindMount {
+			if err := unix.Mount(rootfs, rootfs, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+				errCh <- err
+				return
+			}
+		} else {
+			if err := unix.Mount("tmpfs", rootfs, "tmpfs", 0, ""); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		if privateMount {
+			if err := unix.Mount("", rootfs, "", unix.MS_PRIVATE, ""); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		// The structure is created on top of the mount, as the
+		// tmpfs would hide anything created below it.
+		if err := createFuzzRootfs(c, rootfs); err != nil {
+			errCh <- err
+			return
+		}
+		if mountProc {
+			proc := filepath.Join(rootfs, "proc")
+			if err := os.MkdirAll(proc, 0o755); err == nil {
+				_ = unix.Mount("proc", proc, "proc", 0, "")
+			}
+		}
+
+		if err := pivotRoot(rootfs); err != nil {
+			// A failed pivot_root must leave the old root in place:
+			if _, statErr := os.Stat(dir); statErr != nil {
+				panic(fmt.Sprintf("pivot_root failed (%v) and the old root is gone: %v", err, statErr))
+			}
+			errCh <- err
+			return
+		}
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		return 0
+	}
+	return 1
+}
+
+func FuzzContainerLinuxExecFifoPath(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	existing, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	concurrent, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-exec-fifo")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	fifoName := filepath.Join(root, execFifoFilename)
+
+	// Leave something behind at the exec.fifo path:
+	switch existing % 4 {
+	case 1:
+		err = unix.Mkfifo(fifoName, 0o622)
+	case 2:
+		err = ioutil.WriteFile(fifoName, data, 0o644)
+	case 3:
+		err = os.Mkdir(fifoName, 0o755)
+	}
+	if err != nil {
+		return -1
+	}
+	before, _ := os.Lstat(fifoName)
+
+	n := 1
+	if concurrent {
+		n = 2
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			container := &linuxContainer{
+				id:     "fuzz",
+				root:   root,
+				config: &configs.Config{},
+			}
+			errs[i] = container.createExecFifo()
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if before != nil {
+		// Anything that is already there must be rejected and left alone:
+		if succeeded != 0 {
+			panic(fmt.Sprintf("exec fifo created over an existing %s", before.Mode().Type()))
+		}
+		after, err := os.Lstat(fifoName)
+		if err != nil || after.Mode() != before.Mode() {
+			panic("pre-existing exec fifo path was modified")
+		}
+		return 1
+	}
+	if succeeded != 1 {
+		panic(fmt.Sprintf("%d of %d callers created the exec fifo", succeeded, n))
+	}
+	fi, err := os.Lstat(fifoName)
+	if err != nil {
+		panic(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		panic(fmt.Sprintf("exec fifo is a %s", fi.Mode().Type()))
+	}
+	return 1
+}
+
+// FuzzContainerStateFileLocking runs container state operations from
+// several goroutines. Data races are only reported when the fuzzer is
+// built with the race detector enabled.
+func FuzzContainerStateFileLocking(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	if len(data) < 3 {
+		return -1
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-state-locking")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		return -1
+	}
+	config := &configs.Config{
+		Rootfs: rootfs,
+		Cgroups: &configs.Cgroup{
+			Name:      "fuzz-state-locking",
+			Resources: &configs.Resources{},
+		},
+	}
+	container, err := newContainerWithName("fuzz", filepath.Join(root, "state"), config)
+	if err != nil {
+		return 0
+	}
+	defer container.Destroy()
+	c, ok := container.(*linuxContainer)
+	if !ok {
+		return 0
+	}
+	stateFile := filepath.Join(c.root, stateFilename)
+
+	// The fuzz data is split between the goroutines,
+	// each byte selects the next operation to perform.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		ops := data[i*len(data)/3 : (i+1)*len(data)/3]
+		wg.Add(1)
+		go func(ops []byte) {
+			defer wg.Done()
+			for _, op := range ops {
+				switch op % 5 {
+				case 0:
+					_, _ = c.State()
+				case 1:
+					_, _ = c.OCIState()
+				case 2:
+					c.m.Lock()
+					if s, err := c.currentState(); err == nil {
+						_ = c.saveState(s)
+					}
+					c.m.Unlock()
+				case 3:
+					_ = c.Destroy()
+				case 4:
+					// A reader must never see a partially written state:
+					b, err := ioutil.ReadFile(stateFile)
+					if err != nil {
+						continue
+					}
+					var s State
+					if err := json.Unmarshal(b, &s); err != nil {
+						panic(fmt.Sprintf("torn read of %s: %v", stateFile, err))
+					}
+					if s.ID != c.ID() {
+						panic(fmt.Sprintf("state file has id %q, expected %q", s.ID, c.ID()))
+					}
+				}
+			}
+		}(ops)
+	}
+	wg.Wait()
+	return 1
+}
+
+// FuzzUnmarshalBaseState writes a fuzzed base state as the state file
+// of a container and loads it with the factory. A state that loads
+// must keep the pid and the start time of the init process.
+func FuzzUnmarshalBaseState(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	var base BaseState
+	if err := json.Unmarshal(data, &base); err != nil {
+		return 0
+	}
+	// runc always records the cgroup config:
+	if base.Config.Cgroups == nil {
+		base.Config.Cgroups = &configs.Cgroup{Resources: &configs.Resources{}}
+	}
+	if base.Config.Cgroups.Resources == nil {
+		base.Config.Cgroups.Resources = &configs.Resources{}
+	}
+	b, err := json.Marshal(&State{BaseState: base})
+	if err != nil {
+		return 0
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-base-state")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "fuzz"), 0o700); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "fuzz", stateFilename), b, 0o600); err != nil {
+		return -1
+	}
+
+	f, err := New(root, Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Load("fuzz")
+	if err != nil {
+		return 0
+	}
+
+	state, err := container.State()
+	if err != nil {
+		return 0
+	}
+	if state.InitProcessPid != base.InitProcessPid {
+		panic(fmt.Sprintf("init pid %d loaded as %d", base.InitProcessPid, state.InitProcessPid))
+	}
+	if state.InitProcessStartTime != base.InitProcessStartTime {
+		panic(fmt.Sprintf("init start time %d loaded as %d", base.InitProcessStartTime, state.InitProcessStartTime))
+	}
+	_, _ = container.OCIState()
+	_, _ = container.Status()
+	return 1
+}
+
+// nonRootCaps are the capabilities the container process of
+// FuzzContainerWithNonRootUser keeps. None of them gives access to
+// files of other users.
+var nonRootCaps = []string{"CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+// nonRootCapMask is the mask of nonRootCaps as in /proc/<pid>/status.
+const nonRootCapMask = 1<<unix.CAP_KILL | 1<<unix.CAP_NET_BIND_SERVICE
+
+// FuzzContainerWithNonRootUser resolves the user of the container
+// process the same way setupUser() does, and then sets it up with
+// finalizeNamespace() on a thread that is thrown away, with its own
+// file descriptor table and /dev/null as stdio. setupUser() rejects
+// ids that are not mapped in the user namespace, sets the
+// supplementary groups, which are empty for a numeric user, and keeps
+// the capabilities of the container whatever the uid is. Making the
+// process dumpable again must not give a non-root user access to
+// files of root.
+func FuzzContainerWithNonRootUser(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	t, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var ids struct{ Uid, Gid uint64 }
+	if err := c.GenerateStruct(&ids); err != nil {
+		return -1
+	}
+	var userSpec string
+	switch t % 5 {
+	case 0:
+		userSpec = "0"
+	case 1:
+		userSpec = "65534:65534"
+	case 2:
+		userSpec = strconv.FormatUint(ids.Uid, 10)
+	case 3:
+		userSpec = strconv.FormatUint(ids.Uid, 10) + ":" + strconv.FormatUint(ids.Gid, 10)
+	case 4:
+		if userSpec, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+	passwd, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	group, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	passwd = "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534:nobody:/:/bin/false\n" + passwd
+	group = "root:x:0:\nnogroup:x:65534:\n" + group
+
+	defaultExecUser := user.ExecUser{
+		Uid:  0,
+		Gid:  0,
+		Home: "/",
+	}
+	execUser, err := user.GetExecUser(userSpec, &defaultExecUser, strings.NewReader(passwd), strings.NewReader(group))
+	if err != nil {
+		return 0
+	}
+	const maxID = 1<<31 - 1
+	if execUser.Uid < 0 || execUser.Uid > maxID || execUser.Gid < 0 || execUser.Gid > maxID {
+		panic(fmt.Sprintf("%q resolved to invalid uid/gid %d:%d", userSpec, execUser.Uid, execUser.Gid))
+	}
+	for _, g := range execUser.Sgids {
+		if g < 0 || g > maxID {
+			panic(fmt.Sprintf("%q resolved to invalid supplementary gid %d", userSpec, g))
+		}
+	}
+
+	// Optionally run the container in a user namespace:
+	config := &configs.Config{}
+	userns, err := c.GetBool()
+	if err != nil {
+		return 0
+	}
+	if userns {
+		var m struct{ ContainerID, HostID, Size uint32 }
+		if err := c.GenerateStruct(&m); err != nil {
+			return 0
+		}
+		config.Namespaces = configs.Namespaces([]configs.Namespace{{Type: configs.NEWUSER}})
+		config.UidMappings = []configs.IDMap{{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)}}
+		config.GidMappings = config.UidMappings
+	}
+
+	// The user must map to the right host ids:
+	hostUID, uidErr := config.HostUID(execUser.Uid)
+	hostGID, gidErr := config.HostGID(execUser.Gid)
+	for _, id := range []struct {
+		id, hostID int
+		err        error
+		m          []configs.IDMap
+	}{
+		{execUser.Uid, hostUID, uidErr, config.UidMappings},
+		{execUser.Gid, hostGID, gidErr, config.GidMappings},
+	} {
+		if !userns {
+			if id.err != nil || id.hostID != id.id {
+				panic(fmt.Sprintf("id %d changed to %d without a user namespace: %v", id.id, id.hostID, id.err))
+			}
+			continue
+		}
+		if id.err != nil {
+			continue
+		}
+		m := id.m[0]
+		if id.id < m.ContainerID || id.id >= m.ContainerID+m.Size || id.hostID != m.HostID+id.id-m.ContainerID {
+			panic(fmt.Sprintf("id %d mapped to %d with %+v", id.id, id.hostID, m))
+		}
+	}
+	mapped := uidErr == nil && gidErr == nil
+
+	// A file only root may read:
+	dir, err := ioutil.TempDir("", "fuzz-non-root")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		return -1
+	}
+
+	spec := fmt.Sprintf("%d:%d", execUser.Uid, execUser.Gid)
+	passwdPath, err := user.GetPasswdPath()
+	if err != nil {
+		return -1
+	}
+	groupPath, err := user.GetGroupPath()
+	if err != nil {
+		return -1
+	}
+	expected, err := user.GetExecUserPath(spec, &defaultExecUser, passwdPath, groupPath)
+	if err != nil {
+		return 0
+	}
+	initConfig := &initConfig{
+		Config: config,
+		User:   spec,
+		Capabilities: &configs.Capabilities{
+			Bounding:  nonRootCaps,
+			Effective: nonRootCaps,
+			Permitted: nonRootCaps,
+		},
+	}
+
+	// Changing the uid makes the whole process non-dumpable:
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	if err != nil {
+		return -1
+	}
+	defer func() {
+		_ = unix.Prctl(unix.PR_SET_DUMPABLE, uintptr(dumpable), 0, 0, 0)
+	}()
+
+	type result struct {
+		uid, gid int
+		groups   []int
+		caps     string
+		openErr  error
+		err      error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if err := unix.Unshare(unix.CLONE_FILES | unix.CLONE_FS); err != nil {
+			res.err = err
+			return
+		}
+		null, err := unix.Open("/dev/null", unix.O_RDWR, 0)
+		if err != nil {
+			res.err = err
+			return
+		}
+		for fd := 0; fd < 3; fd++ {
+			if err := unix.Dup2(null, fd); err != nil {
+				res.err = err
+				return
+			}
+		}
+		unix.Close(null)
+
+		if err := finalizeNamespace(initConfig); err != nil {
+			if mapped {
+				panic(fmt.Sprintf("failed to set up user %q with %+v: %v", spec, config.UidMappings, err))
+			}
+			res.err = err
+			return
+		}
+		if !mapped {
+			panic(fmt.Sprintf("unmapped user %q was set up with %+v", spec, config.UidMappings))
+		}
+		res.uid = unix.Getuid()
+		res.gid = unix.Getgid()
+		if res.groups, res.err = unix.Getgroups(); res.err != nil {
+			return
+		}
+		status, err := ioutil.ReadFile("/proc/thread-self/status")
+		if err != nil {
+			res.err = err
+			return
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "CapEff:") {
+				res.caps = strings.TrimSpace(strings.TrimPrefix(line, "CapEff:"))
+			}
+		}
+		if err := unix.Prctl(unix.PR_SET_DUMPABLE, 1, 0, 0, 0); err != nil {
+			res.err = err
+			return
+		}
+		f, err := os.Open(secret)
+		if err == nil {
+			f.Close()
+		}
+		res.openErr = err
+	}()
+	res := <-resCh
+	if res.err != nil {
+		return 0
+	}
+
+	if res.uid != execUser.Uid || res.gid != execUser.Gid {
+		panic(fmt.Sprintf("user %q was set up as %d:%d", spec, res.uid, res.gid))
+	}
+	if len(res.groups) != len(expected.Sgids) {
+		panic(fmt.Sprintf("user %q has groups %v, expected %v", spec, res.groups, expected.Sgids))
+	}
+	if caps, err := strconv.ParseUint(res.caps, 16, 64); err != nil || caps != nonRootCapMask {
+		panic(fmt.Sprintf("user %q has capabilities %q, expected %#x", spec, res.caps, nonRootCapMask))
+	}
+	if execUser.Uid != 0 && res.openErr == nil {
+		panic(fmt.Sprintf("user %q can read a file of root", spec))
+	}
+	return 1
+}
+
+// resctrlReservedNames are the entries the kernel creates in the
+// root of the resctrl filesystem.
+var resctrlReservedNames = []string{"info", "mon_groups", "mon_data", "tasks", "cpus", "cpus_list", "schemata", "mode", "size"}
+
+// FuzzIntelRdtGroupName checks the validation of the Intel RDT group
+// name. The group is named after the container id, so this is the
+// validation done by the factory before the container is created.
+func FuzzIntelRdtGroupName(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	id, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	// Allow generating over-length names:
+	repeat, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	if repeat > 1 {
+		id = strings.Repeat(id, repeat)
+	}
+	l := &LinuxFactory{}
+	if err := l.validateID(id); err != nil {
+		return 0
+	}
+
+	// The group must be created directly below the resctrl root:
+	const root = "/sys/fs/resctrl"
+	path := filepath.Join(root, id)
+	if id == "" || filepath.Dir(path) != root || filepath.Base(path) != id {
+		panic(fmt.Sprintf("group %q escapes the resctrl root: %q", id, path))
+	}
+	for _, name := range resctrlReservedNames {
+		if id == name {
+			panic(fmt.Sprintf("group %q collides with a reserved resctrl entry", id))
+		}
+	}
+	return 1
+}
+
+// FuzzContainerWithMultipleNamespaces creates, joins or skips each of
+// the namespace types and checks the validation and the preparation
+// of the namespace paths done before the init process is started.
+func FuzzContainerWithMultipleNamespaces(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	rootfs, err := ioutil.TempDir("", "fuzz-namespaces")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+
+	const (
+		nsSkip = iota
+		nsNew
+		nsJoinSelf
+		nsJoinMissing
+		nsJoinComma
+		nsModes
+	)
+	config := &configs.Config{Rootfs: rootfs}
+	modes := make(map[configs.NamespaceType]int)
+	for _, t := range configs.NamespaceTypes() {
+		mode, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		mode %= nsModes
+		if mode != nsSkip && !configs.IsNamespaceSupported(t) {
+			return 0
+		}
+		modes[t] = mode
+		switch mode {
+		case nsNew:
+			config.Namespaces.Add(t, "")
+		case nsJoinSelf:
+			config.Namespaces.Add(t, "/proc/self/ns/"+configs.NsName(t))
+		case nsJoinMissing:
+			config.Namespaces.Add(t, filepath.Join(rootfs, "missing", configs.NsName(t)))
+		case nsJoinComma:
+			config.Namespaces.Add(t, "/proc/self/ns/"+configs.NsName(t)+",")
+		}
+	}
+	hostname, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	if hostname {
+		config.Hostname = "fuzz"
+	}
+	maskPaths, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	if maskPaths {
+		config.MaskPaths = []string{"/proc/kcore"}
+	}
+
+	// Settings that need a private namespace must be rejected without it:
+	err = validate.New().Validate(config)
+	switch {
+	case hostname && !config.Namespaces.Contains(configs.NEWUTS):
+		if err == nil {
+			panic("hostname accepted without a UTS namespace")
+		}
+		return 0
+	case maskPaths && !config.Namespaces.Contains(configs.NEWNS):
+		if err == nil {
+			panic("masked paths accepted without a mount namespace")
+		}
+		return 0
+	case err != nil:
+		panic(fmt.Sprintf("failed to validate namespaces %+v: %v", config.Namespaces, err))
+	}
+
+	// Only new namespaces may be cloned. Joining a namespace,
+	// even the one of the caller, must never create a new one.
+	var expectedFlags uintptr
+	for _, ns := range config.Namespaces {
+		if modes[ns.Type] == nsNew {
+			expectedFlags |= uintptr(ns.Syscall())
+		}
+	}
+	if flags := config.Namespaces.CloneFlags(); flags != expectedFlags {
+		panic(fmt.Sprintf("clone flags %#x, expected %#x", flags, expectedFlags))
+	}
+
+	// Joining a namespace that does not exist must fail before
+	// the init process is started:
+	nsMaps := make(map[configs.NamespaceType]string)
+	for _, ns := range config.Namespaces {
+		if ns.Path != "" {
+			nsMaps[ns.Type] = ns.Path
+		}
+	}
+	container := &linuxContainer{config: config}
+	paths, err := container.orderNamespacePaths(nsMaps)
+	invalid := false
+	for _, mode := range modes {
+		if mode == nsJoinMissing || mode == nsJoinComma {
+			invalid = true
+		}
+	}
+	if invalid {
+		if err == nil {
+			panic(fmt.Sprintf("invalid namespace paths were accepted: %q", paths))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to order namespace paths: %v", err))
+	}
+	if len(paths) != len(nsMaps) {
+		panic(fmt.Sprintf("expected %d namespace paths, got %q", len(nsMaps), paths))
+	}
+	// The user namespace must be joined first:
+	if p, ok := nsMaps[configs.NEWUSER]; ok && paths[0] != "user:"+p {
+		panic(fmt.Sprintf("user namespace is not joined first: %q", paths))
+	}
+	return 1
+}
+
+// procMountDestinations are destinations at, below and next to /proc.
+var procMountDestinations = []string{"/proc", "/proc/", "/proc/self", "/proc/cpuinfo", "/proc/sys", "/proc/../proc", "/procfs"}
+
+// FuzzContainerWithPidNamespace checks the PID namespace setup and the
+// /proc mount checks of a container. The container is not started, so
+// the PID of its init process is not checked.
+func FuzzContainerWithPidNamespace(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	pidMode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	destIndex, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	destination, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	if destIndex < len(procMountDestinations) {
+		destination = procMountDestinations[destIndex]
+	}
+	sourceIndex, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-pidns")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	// The host /proc, something inside it and a plain directory:
+	sources := []string{"/proc", "/proc/self", "/proc/self/root", filepath.Join(rootfs, "..")}
+	source := sources[sourceIndex%len(sources)]
+	if err := createFuzzRootfs(c, rootfs); err != nil {
+		return 0
+	}
+
+	// A new PID namespace is cloned, a joined one
+	// must exist before the init process is started:
+	config := &configs.Config{Rootfs: rootfs}
+	switch pidMode % 4 {
+	case 1:
+		config.Namespaces.Add(configs.NEWPID, "")
+	case 2:
+		config.Namespaces.Add(configs.NEWPID, "/proc/self/ns/pid")
+	case 3:
+		config.Namespaces.Add(configs.NEWPID, "/proc/1/ns/pid")
+	}
+	newPid := config.Namespaces.CloneFlags()&unix.CLONE_NEWPID != 0
+	if newPid != (pidMode%4 == 1) {
+		panic(fmt.Sprintf("PID namespace %+v: unexpected clone flags %#x", config.Namespaces, config.Namespaces.CloneFlags()))
+	}
+	if p := config.Namespaces.PathOf(configs.NEWPID); p != "" {
+		container := &linuxContainer{config: config}
+		paths, err := container.orderNamespacePaths(map[configs.NamespaceType]string{configs.NEWPID: p})
+		if err != nil {
+			if _, statErr := os.Lstat(p); statErr == nil {
+				panic(fmt.Sprintf("failed to join existing PID namespace %q: %v", p, err))
+			}
+		} else if len(paths) != 1 || paths[0] != "pid:"+p {
+			panic(fmt.Sprintf("PID namespace %q joined as %q", p, paths))
+		}
+	}
+
+	// Mount the source on the destination the way bind
+	// mounts are checked in mountToRootfs:
+	dest, err := securejoin.SecureJoin(rootfs, destination)
+	if err != nil {
+		return 0
+	}
+	if dest != rootfs && !strings.HasPrefix(dest, rootfs+"/") {
+		panic(fmt.Sprintf("mount destination %q resolved outside of the rootfs: %q", destination, dest))
+	}
+	if err := checkProcMount(rootfs, dest, source); err != nil {
+		return 0
+	}
+	procDir := filepath.Join(rootfs, "proc")
+	switch {
+	case dest == procDir:
+		// Only a proc filesystem may be mounted on /proc:
+		var st unix.Statfs_t
+		if err := unix.Statfs(source, &st); err != nil || st.Type != unix.PROC_SUPER_MAGIC {
+			panic(fmt.Sprintf("%q mounted on top of /proc", source))
+		}
+	case strings.HasPrefix(dest, procDir+"/"):
+		// Only the files emulated by lxcfs may be mounted inside /proc:
+		switch strings.TrimPrefix(dest, rootfs) {
+		case "/proc/cpuinfo", "/proc/diskstats", "/proc/meminfo", "/proc/stat",
+			"/proc/swaps", "/proc/uptime", "/proc/loadavg", "/proc/slabinfo", "/proc/net/dev":
+		default:
+			panic(fmt.Sprintf("%q mounted inside /proc", dest))
+		}
+	}
+	return 1
+}
+
+// ipcSysctls are the IPC sysctls runc allows in a private IPC
+// namespace, followed by a few names that it must not allow.
+var ipcSysctls = []string{
+	"kernel.msgmax",
+	"kernel.msgmnb",
+	"kernel.msgmni",
+	"kernel.sem",
+	"kernel.shmall",
+	"kernel.shmmax",
+	"kernel.shmmni",
+	"kernel.shm_rmid_forced",
+	"fs.mqueue.msg_max",
+	"fs.mqueue.queues_max",
+	"kernel.semmsl",
+	"kernel.msgmax.",
+	"fs.mqueue",
+}
+
+// ipcSysctlValues are the limits the fuzzer writes, from
+// disabling shared memory to INT_MAX and beyond.
+var ipcSysctlValues = []string{"0", "1", "2147483647", "2147483648", "18446744073709551615", "-1", "32000 1024000000 500 32000"}
+
+func FuzzContainerWithIPC(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	ipcMode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	sysctl := make(map[string]string)
+	for {
+		k, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		v, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		key := ipcSysctls[k%len(ipcSysctls)]
+		if k >= len(ipcSysctls) {
+			// A fuzzed fs.mqueue sysctl:
+			suffix, err := c.GetString()
+			if err != nil {
+				break
+			}
+			key = "fs.mqueue." + suffix
+		}
+		sysctl[key] = ipcSysctlValues[v%len(ipcSysctlValues)]
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-ipc")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{
+		Rootfs: rootfs,
+		Sysctl: sysctl,
+	}
+	switch ipcMode % 4 {
+	case 1:
+		config.Namespaces.Add(configs.NEWIPC, "")
+	case 2:
+		config.Namespaces.Add(configs.NEWIPC, "/proc/self/ns/ipc")
+	case 3:
+		config.Namespaces.Add(configs.NEWIPC, "/proc/1/ns/ipc")
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	if len(sysctl) == 0 {
+		return 0
+	}
+
+	// The IPC sysctls are only allowed with an IPC namespace.
+	// runc does not check whether a joined one is the host's:
+	if !config.Namespaces.Contains(configs.NEWIPC) {
+		panic(fmt.Sprintf("sysctls %v allowed without an IPC namespace", sysctl))
+	}
+
+	// Every sysctl must be written below /proc/sys, the
+	// same way writeSystemProperty() builds the path:
+	for key := range sysctl {
+		p := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+		if !strings.HasPrefix(p+"/", "/proc/sys/kernel/") && !strings.HasPrefix(p+"/", "/proc/sys/fs/mqueue/") {
+			panic(fmt.Sprintf("IPC sysctl %q is written to %q", key, p))
+		}
+	}
+	return 1
+}
+
+// FuzzContainerLinuxKernelKeyring checks the session keyring set up by
+// the init process. With NoNewKeyring the init process keeps the
+// keyring of its parent, so only the keyring created otherwise is
+// checked. The keyring is joined on a thread that is thrown away, so
+// the session keyring of the fuzzer itself is left alone.
+func FuzzContainerLinuxKernelKeyring(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	id, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	// Allow generating over-length ids:
+	repeat, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	if repeat > 1 {
+		id = strings.Repeat(id, repeat)
+	}
+	noNewKeyring, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	userns, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	label, err := c.GetString()
+	if err != nil {
+		label = ""
+	}
+
+	l := &LinuxFactory{}
+	if err := l.validateID(id); err != nil {
+		return 0
+	}
+	rootfs, err := ioutil.TempDir("", "fuzz-keyring")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{
+		Rootfs:       rootfs,
+		NoNewKeyring: noNewKeyring,
+		ProcessLabel: label,
+	}
+	if userns {
+		config.Namespaces.Add(configs.NEWUSER, "")
+	}
+	// A label for the keyring is only accepted with SELinux enabled:
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	if config.NoNewKeyring {
+		return 0
+	}
+
+	initConfig := &initConfig{
+		Config:       config,
+		ContainerId:  id,
+		ProcessLabel: label,
+	}
+	standardInit := &linuxStandardInit{config: initConfig}
+	ringname, keepperms, newperms := standardInit.getSessionRingParams()
+
+	// The keyring is specific to the container, and joined
+	// again by every process executed in it:
+	if ringname != "_ses."+id || ringname == "_ses" {
+		panic(fmt.Sprintf("container %q joins the session keyring %q", id, ringname))
+	}
+	setnsInit := &linuxSetnsInit{config: initConfig}
+	if name := setnsInit.getSessionRingName(); name != ringname {
+		panic(fmt.Sprintf("exec joins the session keyring %q instead of %q", name, ringname))
+	}
+	// The existing permissions are kept. Only the search
+	// permission is added: the root of a user namespace is
+	// "other" to the keyring, and the UID otherwise.
+	const (
+		keyUsrSearch = 0x80000
+		keyOthSearch = 0x8
+	)
+	if keepperms != 0xffffffff {
+		panic(fmt.Sprintf("session keyring permissions masked with %#x", keepperms))
+	}
+	expected := uint32(keyUsrSearch)
+	if userns {
+		expected = keyOthSearch
+	}
+	if newperms != expected {
+		panic(fmt.Sprintf("session keyring permissions %#x added, expected %#x (user namespace: %t)", newperms, expected, userns))
+	}
+
+	// Join the keyring the way Init() does, on a thread that
+	// is thrown away afterwards, and join it again for exec:
+	type result struct {
+		serial, again   keys.KeySerial
+		desc, againDesc string
+		err             error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.err = selinux.SetKeyLabel(label); res.err != nil {
+			return
+		}
+		if res.serial, res.err = keys.JoinSessionKeyring(ringname); res.err != nil {
+			return
+		}
+		if res.err = keys.ModKeyringPerm(res.serial, keepperms, newperms); res.err != nil {
+			return
+		}
+		// Switch to an anonymous keyring that holds on to the
+		// container's, so exec has to look it up by its name:
+		if _, _, errno := unix.Syscall(unix.SYS_KEYCTL, unix.KEYCTL_JOIN_SESSION_KEYRING, 0, 0); errno != 0 {
+			res.err = errno
+			return
+		}
+		if _, res.err = unix.KeyctlInt(unix.KEYCTL_LINK, int(res.serial), unix.KEY_SPEC_SESSION_KEYRING, 0, 0); res.err != nil {
+			return
+		}
+		if res.again, res.err = keys.JoinSessionKeyring(setnsInit.getSessionRingName()); res.err != nil {
+			return
+		}
+		if res.desc, res.err = unix.KeyctlString(unix.KEYCTL_DESCRIBE, int(res.serial)); res.err != nil {
+			return
+		}
+		res.againDesc, res.err = unix.KeyctlString(unix.KEYCTL_DESCRIBE, int(res.again))
+	}()
+	res := <-resCh
+	if res.err != nil {
+		// Ids that are too long for a keyring description
+		// are rejected by the kernel.
+		return 0
+	}
+	// Keyrings are looked up by name, so exec may join another
+	// keyring of that name than the one the container created:
+	for _, d := range []string{res.desc, res.againDesc} {
+		desc := strings.Split(d, ";")
+		if len(desc) < 5 || desc[0] != "keyring" || desc[len(desc)-1] != ringname {
+			panic(fmt.Sprintf("session keyring %q is described as %q", ringname, d))
+		}
+	}
+	desc := strings.Split(res.desc, ";")
+	perm, err := strconv.ParseUint(desc[3], 16, 32)
+	if err != nil || uint32(perm)&newperms != newperms {
+		panic(fmt.Sprintf("session keyring %q has permissions %s, expected %#x to be set", ringname, desc[3], newperms))
+	}
+	return 1
+}
+
+// netnsPaths are network namespace paths to join: the namespace of
+// the host, files that are not a network namespace and paths that do
+// not exist.
+var netnsPaths = []string{
+	"/proc/self/ns/net",
+	"/proc/1/ns/net",
+	"/proc/self/task/../ns/net",
+	"/dev/null",
+	"/proc/self/ns/mnt",
+	"/proc/self/ns",
+	"/proc/0/ns/net",
+	"/var/run/netns/missing",
+}
+
+// FuzzContainerWithNetworkNamespaceJoin joins an existing network
+// namespace. runc only checks that the path exists before the init
+// process is started; a path that is not a network namespace is
+// rejected by setns(2) in nsexec with EINVAL. Joining the namespace
+// of runc itself is allowed, and so is setting up the network in a
+// joined namespace.
+func FuzzContainerWithNetworkNamespaceJoin(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	loopback, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	var path string
+	switch {
+	case i < len(netnsPaths):
+		path = netnsPaths[i]
+	case i == len(netnsPaths):
+		// A namespace that is gone once the container is started:
+		f, err := os.Open("/proc/self/ns/net")
+		if err != nil {
+			return -1
+		}
+		path = "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+		f.Close()
+	default:
+		path, err = c.GetString()
+		if err != nil || path == "" {
+			return -1
+		}
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-netns")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{Rootfs: rootfs}
+	config.Namespaces.Add(configs.NEWNET, path)
+	if loopback {
+		config.Networks = []*configs.Network{{Type: "loopback"}}
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	if config.Namespaces.CloneFlags()&unix.CLONE_NEWNET != 0 {
+		panic(fmt.Sprintf("joining %q creates a new network namespace", path))
+	}
+
+	container := &linuxContainer{config: config}
+	paths, err := container.orderNamespacePaths(map[configs.NamespaceType]string{configs.NEWNET: path})
+	var st unix.Stat_t
+	if lerr := unix.Lstat(path, &st); lerr != nil {
+		if err == nil {
+			panic(fmt.Sprintf("missing namespace %q was accepted: %q", path, paths))
+		}
+		return 0
+	}
+	if err != nil {
+		if !strings.Contains(path, ",") {
+			panic(fmt.Sprintf("failed to join namespace %q: %v", path, err))
+		}
+		return 0
+	}
+	if len(paths) != 1 || paths[0] != "net:"+path {
+		panic(fmt.Sprintf("namespace %q is joined as %q", path, paths))
+	}
+	return 1
+}
+
+// criuVersions are the CRIU versions below and at the versions
+// supporting external network and PID namespaces.
+var criuVersions = []int{30000, 31100, 31500}
+
+// FuzzCriuRestoreNamespaces checkpoints a container with one config
+// and restores it with another. runc does not compare the two configs:
+// it passes the namespaces joined by each of them to CRIU, which fails
+// the restore if they do not match the images. Rootfs and cgroup paths
+// are taken from the restore config only.
+func FuzzCriuRestoreNamespaces(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	v, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	criuVersion := criuVersions[v%len(criuVersions)]
+
+	const (
+		nsSkip = iota
+		nsNew
+		nsJoinSelf
+		nsJoinMissing
+		nsModes
+	)
+	newConfig := func() (*configs.Config, map[configs.NamespaceType]int, error) {
+		config := &configs.Config{}
+		modes := make(map[configs.NamespaceType]int)
+		for _, t := range configs.NamespaceTypes() {
+			mode, err := c.GetInt()
+			if err != nil {
+				return nil, nil, err
+			}
+			mode %= nsModes
+			modes[t] = mode
+			switch mode {
+			case nsNew:
+				config.Namespaces.Add(t, "")
+			case nsJoinSelf:
+				config.Namespaces.Add(t, "/proc/self/ns/"+configs.NsName(t))
+			case nsJoinMissing:
+				config.Namespaces.Add(t, "/proc/self/ns/missing-"+configs.NsName(t))
+			}
+		}
+		return config, modes, nil
+	}
+	dumpConfig, dumpModes, err := newConfig()
+	if err != nil {
+		return -1
+	}
+	restoreConfig, restoreModes, err := newConfig()
+	if err != nil {
+		return -1
+	}
+
+	dumpOpts := &criurpc.CriuOpts{}
+	dump := &linuxContainer{config: dumpConfig, criuVersion: criuVersion}
+	for _, t := range []configs.NamespaceType{configs.NEWNET, configs.NEWPID} {
+		if err := dump.handleCheckpointingExternalNamespaces(dumpOpts, t); err != nil {
+			if dumpModes[t] != nsJoinMissing {
+				panic(fmt.Sprintf("failed to checkpoint %s namespace: %v", configs.NsName(t), err))
+			}
+			return 0
+		}
+	}
+
+	restoreOpts := &criurpc.CriuOpts{}
+	restore := &linuxContainer{config: restoreConfig, criuVersion: criuVersion}
+	var extraFiles []*os.File
+	err = restore.handleRestoringNamespaces(restoreOpts, &extraFiles)
+	defer func() {
+		for _, f := range extraFiles {
+			f.Close()
+		}
+	}()
+	if restoreModes[configs.NEWCGROUP] >= nsJoinSelf {
+		// CRIU cannot join a cgroup namespace:
+		if err == nil {
+			panic("cgroup namespace joined on restore")
+		}
+		return 0
+	}
+	if err != nil {
+		for _, t := range []configs.NamespaceType{configs.NEWNET, configs.NEWPID} {
+			if restoreModes[t] == nsJoinMissing && restore.criuSupportsExtNS(t) {
+				return 0
+			}
+		}
+		panic(fmt.Sprintf("failed to restore namespaces %+v: %v", restoreConfig.Namespaces, err))
+	}
+
+	// Namespaces dumped as external must be inherited
+	// on restore with the same key, and only those:
+	dumped := make(map[string]bool)
+	for _, ext := range dumpOpts.External {
+		dumped[ext[strings.LastIndex(ext, ":")+1:]] = true
+	}
+	if len(restoreOpts.InheritFd) != len(extraFiles) {
+		panic(fmt.Sprintf("%d namespaces inherited with %d files", len(restoreOpts.InheritFd), len(extraFiles)))
+	}
+	for _, fd := range restoreOpts.InheritFd {
+		key := fd.GetKey()
+		t := configs.NEWNET
+		if key == criuNsToKey(configs.NEWPID) {
+			t = configs.NEWPID
+		} else if key != criuNsToKey(configs.NEWNET) {
+			panic(fmt.Sprintf("unknown external namespace key %q", key))
+		}
+		if dumpModes[t] == nsJoinSelf && !dumped[key] {
+			panic(fmt.Sprintf("namespace %q inherited, but not dumped as external", key))
+		}
+	}
+	for key := range dumped {
+		if key != criuNsToKey(configs.NEWNET) && key != criuNsToKey(configs.NEWPID) {
+			panic(fmt.Sprintf("unknown external namespace key %q", key))
+		}
+	}
+
+	// All other joined namespaces are passed as is:
+	for _, ns := range restoreOpts.JoinNs {
+		t := configs.NamespaceType("")
+		for _, nt := range configs.NamespaceTypes() {
+			if configs.NsName(nt) == ns.GetNs() {
+				t = nt
+			}
+		}
+		if t == "" || t == configs.NEWNET || t == configs.NEWPID {
+			panic(fmt.Sprintf("namespace %q joined by CRIU", ns.GetNs()))
+		}
+		if p := restoreConfig.Namespaces.PathOf(t); p == "" || p != ns.GetNsFile() {
+			panic(fmt.Sprintf("namespace %q joined at %q, configured %q", ns.GetNs(), ns.GetNsFile(), p))
+		}
+	}
+	return 1
+}
+
+// tmpfsData are tmpfs mount options, including a size of 0,
+// which means that the size of the tmpfs is not limited.
+var tmpfsData = []string{"", "size=0", "size=1k", "mode=1777", "mode=0", "nr_inodes=2", "size=65536k,mode=755"}
+
+// FuzzContainerLinuxTmpMount mounts /tmp in a rootfs, either as a tmpfs,
+// a bind mount of a directory standing in for the host /tmp, or a tmpfs
+// with another mount below it. The rootfs may not contain /tmp. Only a
+// bind mount may share files with the host.
+func FuzzContainerLinuxTmpMount(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	d, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	tmpData := tmpfsData[d%len(tmpfsData)]
+	if d >= len(tmpfsData) {
+		tmpData, err = c.GetString()
+		if err != nil {
+			return -1
+		}
+	}
+	createTmp, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-tmp-mount")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	hostTmp := filepath.Join(dir, "host-tmp")
+	for _, p := range []string{rootfs, hostTmp} {
+		if err := os.Mkdir(p, 0o755); err != nil {
+			return -1
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(hostTmp, "host"), nil, 0o644); err != nil {
+		return -1
+	}
+	if createTmp {
+		if err := os.Mkdir(filepath.Join(rootfs, "tmp"), 0o1777); err != nil {
+			return -1
+		}
+	}
+
+	const (
+		tmpTmpfs = iota
+		tmpBind
+		tmpNested
+		tmpModes
+	)
+	mode %= tmpModes
+	tmpfs := &configs.Mount{
+		Source:      "tmpfs",
+		Destination: "/tmp",
+		Device:      "tmpfs",
+		Flags:       unix.MS_NOSUID | unix.MS_NODEV,
+		Data:        tmpData,
+	}
+	mounts := []*configs.Mount{tmpfs}
+	switch mode {
+	case tmpBind:
+		mounts = []*configs.Mount{{
+			Source:      hostTmp,
+			Destination: "/tmp",
+			Device:      "bind",
+			Flags:       unix.MS_BIND | unix.MS_REC,
+		}}
+	case tmpNested:
+		mounts = append(mounts, &configs.Mount{
+			Source:      "tmpfs",
+			Destination: "/tmp/foo",
+			Device:      "tmpfs",
+		})
+	}
+
+	// Mounting has to happen in a separate mount namespace.
+	// The thread is locked and never unlocked, so the Go
+	// runtime throws it away once the goroutine exits.
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); err != nil {
+			errCh <- err
+			return
+		}
+		if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+			errCh <- err
+			return
+		}
+		for _, m := range mounts {
+			if err := mountToRootfs(m, &mountConfig{root: rootfs}); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		tmp := filepath.Join(rootfs, "tmp")
+		if fi, err := os.Stat(tmp); err != nil || !fi.IsDir() {
+			panic(fmt.Sprintf("/tmp was not created in the rootfs: %v", err))
+		}
+		_, err := os.Stat(filepath.Join(tmp, "host"))
+		if (err == nil) != (mode == tmpBind) {
+			panic(fmt.Sprintf("host /tmp visible in the container with %+v: %v", mounts[0], err))
+		}
+		if mode == tmpNested {
+			var st unix.Statfs_t
+			if err := unix.Statfs(filepath.Join(tmp, "foo"), &st); err != nil {
+				panic(fmt.Sprintf("/tmp/foo was not mounted: %v", err))
+			}
+		}
+		// A full tmpfs is not an error of the mount:
+		_ = ioutil.WriteFile(filepath.Join(tmp, "container"), nil, 0o644)
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		return 0
+	}
+
+	// Files created in a tmpfs must not reach the host:
+	_, err = os.Stat(filepath.Join(hostTmp, "container"))
+	if mode != tmpBind && err == nil {
+		panic(fmt.Sprintf("file created in the tmpfs /tmp (%q) is visible on the host", tmpData))
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "tmp", "container")); err == nil {
+		panic(fmt.Sprintf("file created in /tmp (%+v) is visible in the rootfs on the host", mounts[0]))
+	}
+	return 1
+}
+
+// passedFilesCounts are counts of passed files to try besides the
+// actual one: none, more than were passed and ones that overflow.
+var passedFilesCounts = []int{0, 1, 3, 100, 999, math.MaxInt32, math.MaxInt64 - 2, math.MaxInt64}
+
+// FuzzContainerLinuxPassedFDs sends an initConfig with a fuzzed
+// PassedFilesCount to the init process, which has been given a number
+// of pipes, and runs finalizeNamespace() on it. runc does not check the
+// count against the files actually passed: it only marks the file
+// descriptors after the passed ones as close-on-exec, so no count is
+// an error. A count within 3 of the maximum int overflows, and then
+// every file descriptor, stdio included, is marked. finalizeNamespace()
+// also drops the capabilities and changes the user, so it is run on a
+// thread that is thrown away, with its own file descriptor table and
+// /dev/null as stdio, which leaves the fuzzer's own file descriptors
+// and stdio untouched.
+func FuzzContainerLinuxPassedFDs(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	n %= 4
+
+	// Pass n pipes, inheritable like the ExtraFiles of the init process:
+	var passed []int
+	defer func() {
+		for _, fd := range passed {
+			unix.Close(fd)
+		}
+	}()
+	for len(passed) < 2*n {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return -1
+		}
+		for _, f := range []*os.File{r, w} {
+			fd, err := unix.Dup(int(f.Fd()))
+			f.Close()
+			if err != nil {
+				return -1
+			}
+			passed = append(passed, fd)
+		}
+	}
+	count := len(passed)
+	if i < len(passedFilesCounts) {
+		count = passedFilesCounts[i]
+	}
+
+	// The config reaches the init process as JSON:
+	b, err := json.Marshal(&initConfig{PassedFilesCount: count})
+	if err != nil {
+		return -1
+	}
+	config := &initConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		panic(fmt.Sprintf("failed to decode %s: %v", b, err))
+	}
+	if config.PassedFilesCount != count {
+		panic(fmt.Sprintf("passed files count %d was decoded as %d", count, config.PassedFilesCount))
+	}
+	config.Config = &configs.Config{}
+
+	type result struct {
+		stdio, passed []int
+		err           error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.err = unix.Unshare(unix.CLONE_FILES | unix.CLONE_FS); res.err != nil {
+			return
+		}
+		null, err := unix.Open("/dev/null", unix.O_RDWR, 0)
+		if err != nil {
+			res.err = err
+			return
+		}
+		for fd := 0; fd < 3; fd++ {
+			if res.err = unix.Dup2(null, fd); res.err != nil {
+				return
+			}
+		}
+		unix.Close(null)
+
+		if err := finalizeNamespace(config); err != nil {
+			panic(fmt.Sprintf("init failed with %d passed files and count %d: %v", len(passed), count, err))
+		}
+		for fd := 0; fd < 3; fd++ {
+			flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+			if err != nil {
+				panic(fmt.Sprintf("stdio fd %d is gone: %v", fd, err))
+			}
+			res.stdio = append(res.stdio, flags)
+		}
+		for _, fd := range passed {
+			flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+			if err != nil {
+				panic(fmt.Sprintf("passed fd %d is gone: %v", fd, err))
+			}
+			res.passed = append(res.passed, flags)
+		}
+	}()
+	res := <-resCh
+	if res.err != nil {
+		return 0
+	}
+
+	// Only the file descriptors below the count are inherited:
+	minFd := config.PassedFilesCount + 3
+	for fd, flags := range res.stdio {
+		if (flags&unix.FD_CLOEXEC != 0) != (fd >= minFd) {
+			panic(fmt.Sprintf("stdio fd %d with count %d has flags %#x", fd, count, flags))
+		}
+	}
+	for j, fd := range passed {
+		if (res.passed[j]&unix.FD_CLOEXEC != 0) != (fd >= minFd) {
+			panic(fmt.Sprintf("passed fd %d with count %d has flags %#x", fd, count, res.passed[j]))
+		}
+	}
+	return 1
+}
+
+// FuzzMemoryPressureLevel registers for memory pressure notifications
+// in a mock cgroup v1 memory cgroup. The level is a PressureLevel, not
+// a string, and is converted to the level written to
+// cgroup.event_control, which the kernel matches case-sensitively.
+func FuzzMemoryPressureLevel(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	v := struct{ Level uint }{}
+	if err := c.GenerateStruct(&v); err != nil {
+		return -1
+	}
+	level := PressureLevel(v.Level)
+	small, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	if small {
+		level %= 4
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-memory-pressure")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	eventControl := filepath.Join(dir, "cgroup.event_control")
+	for _, f := range []string{"memory.pressure_level", "cgroup.event_control"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0o644); err != nil {
+			return -1
+		}
+	}
+
+	ch, err := notifyMemoryPressure(dir, level)
+	written, rErr := ioutil.ReadFile(eventControl)
+	if rErr != nil {
+		return -1
+	}
+	if level > CriticalPressure {
+		if err == nil || len(written) != 0 {
+			panic(fmt.Sprintf("unknown pressure level %d was registered as %q", level, written))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to register pressure level %d: %v", level, err))
+	}
+
+	var efd, evfd int
+	var arg string
+	if _, err := fmt.Sscanf(string(written), "%d %d %s", &efd, &evfd, &arg); err != nil {
+		panic(fmt.Sprintf("pressure level %d was registered as %q: %v", level, written, err))
+	}
+	// Stop the notifications: once the cgroup is gone,
+	// the eventfd is closed and no event is sent.
+	if err := os.Remove(eventControl); err != nil {
+		return -1
+	}
+	if _, err := unix.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		panic(fmt.Sprintf("eventfd %d of pressure level %d: %v", efd, level, err))
+	}
+	if _, ok := <-ch; ok {
+		panic("pressure event sent for a removed cgroup")
+	}
+
+	expected := map[PressureLevel]string{
+		LowPressure:      "low",
+		MediumPressure:   "medium",
+		CriticalPressure: "critical",
+	}
+	if arg != expected[level] {
+		panic(fmt.Sprintf("pressure level %d was registered as %q, expected %q", level, arg, expected[level]))
+	}
+	return 1
+}
+
+// FuzzContainerStateLabels saves the labels of a container in its
+// state, loads the container again and splits the labels into the
+// bundle and the annotations of its OCI state. Labels are split on
+// the first "=" only, and the last of duplicate keys wins.
+func FuzzContainerStateLabels(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	labels := []string{}
+	for {
+		t, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		key, err := c.GetString()
+		if err != nil {
+			break
+		}
+		value, err := c.GetString()
+		if err != nil {
+			break
+		}
+		switch {
+		case t%4 == 1:
+			key = "bundle"
+		case t%4 == 2 && len(labels) > 0:
+			// Duplicate one of the keys:
+			key = strings.SplitN(labels[t%len(labels)], "=", 2)[0]
+		case t%4 == 3:
+			value += "=" + value
+		}
+		labels = append(labels, key+"="+value)
+	}
+
+	expected := make(map[string]string)
+	var bundle string
+	for _, l := range labels {
+		i := strings.Index(l, "=")
+		if l[:i] == "bundle" {
+			bundle = l[i+1:]
+			continue
+		}
+		expected[l[:i]] = l[i+1:]
+	}
+
+	base := BaseState{
+		ID: "fuzz",
+		Config: configs.Config{
+			Labels:  labels,
+			Cgroups: &configs.Cgroup{Resources: &configs.Resources{}},
+		},
+	}
+	b, err := json.Marshal(&State{BaseState: base})
+	if err != nil {
+		return 0
+	}
+	root, err := ioutil.TempDir("", "fuzz-state-labels")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "fuzz"), 0o700); err != nil {
+		return -1
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "fuzz", stateFilename), b, 0o600); err != nil {
+		return -1
+	}
+	f, err := New(root, Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Load("fuzz")
+	if err != nil {
+		return 0
+	}
+	state, err := container.OCIState()
+	if err != nil {
+		return 0
+	}
+
+	if state.Bundle != bundle {
+		panic(fmt.Sprintf("labels %q: bundle %q, expected %q", labels, state.Bundle, bundle))
+	}
+	// runc exec looks the bundle up in the labels as well:
+	if b := utils.SearchLabels(labels, "bundle"); b != state.Bundle {
+		panic(fmt.Sprintf("labels %q: bundle %q in the state, but %q for exec", labels, state.Bundle, b))
+	}
+	if len(state.Annotations) != len(expected) {
+		panic(fmt.Sprintf("labels %q: annotations %q, expected %q", labels, state.Annotations, expected))
+	}
+	for k, v := range expected {
+		if got, ok := state.Annotations[k]; !ok || got != v {
+			panic(fmt.Sprintf("labels %q: annotation %q is %q, expected %q", labels, k, got, v))
+		}
+	}
+	return 1
+}
+
+// FuzzRootfsReadonlyRemount makes a tmpfs, mounted with some of the
+// nosuid, nodev, noexec and ro flags, read-only the way a readonly
+// rootfs, a read-only mount and a read-only path are. The security
+// flags the mount had must never be dropped.
+func FuzzRootfsReadonlyRemount(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var flags uintptr
+	for _, f := range []uintptr{unix.MS_NOSUID, unix.MS_NODEV, unix.MS_NOEXEC, unix.MS_RDONLY} {
+		set, err := c.GetBool()
+		if err != nil {
+			return -1
+		}
+		if set {
+			flags |= f
+		}
+	}
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-readonly")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	// Mounting has to happen in a separate mount namespace.
+	// The thread is locked and never unlocked, so the Go
+	// runtime throws it away once the goroutine exits.
+	type result struct {
+		st  unix.Statfs_t
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.err = unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); res.err != nil {
+			return
+		}
+		if res.err = unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); res.err != nil {
+			return
+		}
+		if res.err = unix.Mount("tmpfs", dir, "tmpfs", flags, ""); res.err != nil {
+			return
+		}
+		path := dir
+		switch mode % 3 {
+		case 0:
+			// The rootfs, after pivot_root:
+			if res.err = unix.Chroot(dir); res.err != nil {
+				return
+			}
+			if res.err = unix.Chdir("/"); res.err != nil {
+				return
+			}
+			path = "/"
+			res.err = setReadonly()
+		case 1:
+			res.err = remountReadonly(&configs.Mount{Destination: dir, Flags: int(flags)})
+		case 2:
+			res.err = readonlyPath(dir)
+		}
+		if res.err != nil {
+			return
+		}
+		res.err = unix.Statfs(path, &res.st)
+	}()
+	res := <-resCh
+	if res.err != nil {
+		return 0
+	}
+
+	got := uintptr(res.st.Flags)
+	if got&unix.ST_RDONLY == 0 {
+		panic(fmt.Sprintf("mount with flags %#x is not read-only (mode %d): %#x", flags, mode%3, got))
+	}
+	for _, f := range []uintptr{unix.MS_NOSUID, unix.MS_NODEV, unix.MS_NOEXEC} {
+		// The ST_* flags of statfs(2) match the MS_* flags:
+		if flags&f != 0 && got&f == 0 {
+			panic(fmt.Sprintf("read-only remount (mode %d) dropped flag %#x: %#x -> %#x", mode%3, f, flags, got))
+		}
+	}
+	return 1
+}
+
+// appArmorProfiles are AppArmor profile names, including
+// profiles that are not loaded and names that are not valid.
+var appArmorProfiles = []string{"", "runc-default", "docker-default", "unconfined", "nonexistent-profile", "a b", "exec foo\n", "/usr/bin/foo"}
+
+// FuzzContainerLinuxAppArmorInteraction builds the init config of a
+// container or exec process that is confined by both AppArmor and
+// seccomp. The validator does not look at the profile, and a profile
+// that is not loaded is only rejected when it is applied, while the
+// container starts. The profile of an exec process replaces the one of
+// the container, but an empty one must not unconfine the process, and
+// neither may drop seccomp or no_new_privs.
+func FuzzContainerLinuxAppArmorInteraction(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var profiles [2]string
+	for i := range profiles {
+		n, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		profiles[i] = appArmorProfiles[n%len(appArmorProfiles)]
+		if n >= len(appArmorProfiles) {
+			if profiles[i], err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+	}
+	configProfile, processProfile := profiles[0], profiles[1]
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	nnp, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	var seccomp *configs.Seccomp
+	switch mode % 3 {
+	case 1:
+		// Block prctl, which is not needed for AppArmor:
+		seccomp = &configs.Seccomp{
+			DefaultAction: configs.Allow,
+			Syscalls: []*configs.Syscall{
+				{Name: "prctl", Action: configs.Errno},
+			},
+		}
+	case 2:
+		action, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		seccomp = &configs.Seccomp{DefaultAction: configs.Action(action)}
+	}
+
+	config := &configs.Config{
+		Rootfs:          "/var/run/runc/fuzz/rootfs",
+		AppArmorProfile: configProfile,
+		Seccomp:         seccomp,
+		NoNewPrivileges: nnp,
+		Namespaces:      configs.Namespaces{{Type: configs.NEWNS}},
+		Cgroups:         &configs.Cgroup{Resources: &configs.Resources{}},
+	}
+	m, err := fs2.NewManager(config.Cgroups, "/sys/fs/cgroup/fuzz", false)
+	if err != nil {
+		return -1
+	}
+	container := &linuxContainer{id: "fuzz", config: config, cgroupManager: m}
+	cfg := container.newInitConfig(&Process{Args: []string{"sh"}, AppArmorProfile: processProfile})
+
+	expected := configProfile
+	if processProfile != "" {
+		expected = processProfile
+	}
+	if cfg.AppArmorProfile != expected {
+		panic(fmt.Sprintf("profiles %q and %q resulted in %q", configProfile, processProfile, cfg.AppArmorProfile))
+	}
+	if cfg.Config.Seccomp != seccomp || cfg.NoNewPrivileges != nnp {
+		panic(fmt.Sprintf("AppArmor profile %q changed seccomp: %+v, no_new_privs %t", cfg.AppArmorProfile, cfg.Config.Seccomp, cfg.NoNewPrivileges))
+	}
+
+	return 1
+}
+
+// FuzzContainerDestroyIdempotency destroys a container that was
+// created but never started, after its state directory was optionally
+// corrupted, and then destroys it again. The container has its own pid
+// namespace, so destroying it does not signal the processes of a
+// cgroup it never created.
+func FuzzContainerDestroyIdempotency(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	joinCgroup, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	content, err := c.GetBytes()
+	if err != nil {
+		content = nil
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-destroy")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		return -1
+	}
+	stateRoot := filepath.Join(root, "state")
+
+	config := &configs.Config{
+		Rootfs: rootfs,
+		Namespaces: configs.Namespaces{
+			{Type: configs.NEWNS},
+			{Type: configs.NEWPID},
+		},
+		Cgroups: &configs.Cgroup{
+			// The cgroup does not exist:
+			Name:      filepath.Base(root),
+			Parent:    "fuzz-destroy",
+			Resources: &configs.Resources{},
+		},
+	}
+	if joinCgroup {
+		config.Cgroups.Paths = map[string]string{"devices": filepath.Join(root, "cgroup")}
+	}
+	f, err := New(stateRoot, Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Create("fuzz", config)
+	if err != nil {
+		return 0
+	}
+	lc := container.(*linuxContainer)
+
+	stateDir := filepath.Join(stateRoot, "fuzz")
+	stateFile := filepath.Join(stateDir, stateFilename)
+	switch mode % 5 {
+	case 1:
+		// The state file is already gone:
+		state, err := lc.currentState()
+		if err != nil {
+			return -1
+		}
+		if err := lc.saveState(state); err != nil {
+			return -1
+		}
+		if err := os.Remove(stateFile); err != nil {
+			return -1
+		}
+	case 2:
+		// The state file is corrupted:
+		if err := ioutil.WriteFile(stateFile, content, 0o600); err != nil {
+			return -1
+		}
+	case 3:
+		// The state directory is already gone:
+		if err := os.RemoveAll(stateDir); err != nil {
+			return -1
+		}
+	case 4:
+		// Something else is in the state directory:
+		if err := os.MkdirAll(filepath.Join(stateDir, "sub", "dir"), 0o500); err != nil {
+			return -1
+		}
+		if err := ioutil.WriteFile(filepath.Join(stateDir, "sub", "file"), content, 0o400); err != nil {
+			return -1
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := container.Destroy(); err != nil && i == 1 {
+			panic(fmt.Sprintf("second destroy failed: %v", err))
+		}
+		if _, err := os.Lstat(stateDir); !os.IsNotExist(err) {
+			panic(fmt.Sprintf("state directory left behind after destroy %d: %v", i+1, err))
+		}
+		status, err := container.Status()
+		if err != nil || status != Stopped {
+			panic(fmt.Sprintf("container is %s after destroy %d: %v", status, i+1, err))
+		}
+	}
+	return 1
+}
+
+// cgroupnsPaths are cgroup namespace paths to join, including
+// files that are not a cgroup namespace and paths that do not exist.
+var cgroupnsPaths = []string{
+	"/proc/self/ns/cgroup",
+	"/proc/thread-self/ns/cgroup",
+	"/proc/self/ns/net",
+	"/dev/null",
+	"/var/run/cgroupns/missing",
+	"/proc/self/ns/cgroup,/proc/self/ns/net",
+}
+
+// FuzzContainerLinuxWithCgroupNs sets up the cgroup namespace of a
+// container the way nsexec does: a namespace path is joined with
+// setns(2), and a new namespace is unshared once the init process is
+// in its cgroup. In a new namespace the current cgroup is the root of
+// every hierarchy, while without one, or in the namespace of runc,
+// the full cgroup paths are seen.
+func FuzzContainerLinuxWithCgroupNs(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	mode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var path string
+	if mode%3 == 2 {
+		i, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		path = cgroupnsPaths[i%len(cgroupnsPaths)]
+		if i >= len(cgroupnsPaths) {
+			if path, err = c.GetString(); err != nil || path == "" {
+				return -1
+			}
+		}
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-cgroupns")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{Rootfs: rootfs}
+	config.Namespaces.Add(configs.NEWNS, "")
+	if mode%3 != 0 {
+		config.Namespaces.Add(configs.NEWCGROUP, path)
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	container := &linuxContainer{id: "fuzz", config: config}
+	nsMaps := make(map[configs.NamespaceType]string)
+	for _, ns := range config.Namespaces {
+		if ns.Path != "" {
+			nsMaps[ns.Type] = ns.Path
+		}
+	}
+	if _, err := container.orderNamespacePaths(nsMaps); err != nil {
+		return 0
+	}
+
+	// The namespace is changed on a thread that is thrown away:
+	type result struct {
+		host, view string
+		err        error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		var b []byte
+		if b, res.err = ioutil.ReadFile("/proc/thread-self/cgroup"); res.err != nil {
+			return
+		}
+		res.host = string(b)
+		switch {
+		case path != "":
+			fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				res.err = err
+				return
+			}
+			res.err = unix.Setns(fd, unix.CLONE_NEWCGROUP)
+			unix.Close(fd)
+		case config.Namespaces.Contains(configs.NEWCGROUP):
+			res.err = unix.Unshare(unix.CLONE_NEWCGROUP)
+		}
+		if res.err != nil {
+			return
+		}
+		b, res.err = ioutil.ReadFile("/proc/thread-self/cgroup")
+		res.view = string(b)
+	}()
+	res := <-resCh
+	if res.err != nil {
+		return 0
+	}
+
+	switch {
+	case path != "":
+		var st, self unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return 0
+		}
+		if err := unix.Stat("/proc/self/ns/cgroup", &self); err != nil {
+			return 0
+		}
+		if st.Ino != self.Ino || st.Dev != self.Dev {
+			return 0
+		}
+		fallthrough
+	case !config.Namespaces.Contains(configs.NEWCGROUP):
+		if res.view != res.host {
+			panic(fmt.Sprintf("cgroups %q are seen as %q in the cgroup namespace of runc", res.host, res.view))
+		}
+	default:
+		for _, line := range strings.Split(strings.TrimSpace(res.view), "\n") {
+			// hierarchy-ID:controller-list:cgroup-path
+			parts := strings.SplitN(line, ":", 3)
+			if len(parts) != 3 || parts[2] != "/" {
+				panic(fmt.Sprintf("cgroup %q is not the root of the new cgroup namespace (host: %q)", line, res.host))
+			}
+		}
+	}
+	return 1
+}
+
+// utsNames are host and domain names around the kernel's limit of
+// __NEW_UTS_LEN (64) bytes, including characters that are not valid
+// in a DNS name.
+var utsNames = []string{
+	"", "fuzz", "host.example.com", "host_name", "a b", "-", "a\x00b", "host\n",
+	strings.Repeat("a", 64), strings.Repeat("a", 65),
+}
+
+// FuzzContainerLinuxWithUTSNamespace sets the host name and the domain
+// name the way the init process does, on a thread that is thrown away.
+// This version of runc has no domainname in the config: it is set with
+// the kernel.domainname sysctl. An empty host name is not set, so the
+// container keeps the host name of the host, not its id. Without a UTS
+// namespace the validator must reject both, as setting them would
+// change the names of the host.
+func FuzzContainerLinuxWithUTSNamespace(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	var names [2]string
+	for i := range names {
+		n, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		names[i] = utsNames[n%len(utsNames)]
+		if n >= len(utsNames) {
+			if names[i], err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+	}
+	hostname, domainname := names[0], names[1]
+	utsns, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-uts")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{Rootfs: rootfs, Hostname: hostname}
+	if domainname != "" {
+		config.Sysctl = map[string]string{"kernel.domainname": domainname}
+	}
+	if utsns {
+		config.Namespaces.Add(configs.NEWUTS, "")
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	if !utsns && (hostname != "" || domainname != "") {
+		panic(fmt.Sprintf("names %q and %q would be set without a UTS namespace", hostname, domainname))
+	}
+	if !utsns {
+		return 0
+	}
+
+	var host unix.Utsname
+	if err := unix.Uname(&host); err != nil {
+		return -1
+	}
+	type result struct {
+		uts         unix.Utsname
+		hostnameErr error
+		domainErr   error
+		unshareErr  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_NEWUTS); res.unshareErr != nil {
+			return
+		}
+		if config.Hostname != "" {
+			res.hostnameErr = unix.Sethostname([]byte(config.Hostname))
+		}
+		for key, value := range config.Sysctl {
+			res.domainErr = writeSystemProperty(key, value)
+		}
+		_ = unix.Uname(&res.uts)
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+
+	var after unix.Utsname
+	if err := unix.Uname(&after); err != nil {
+		return -1
+	}
+	if after != host {
+		panic(fmt.Sprintf("names %q and %q changed the names of the host", hostname, domainname))
+	}
+
+	got := func(b [65]byte) string {
+		return unix.ByteSliceToString(b[:])
+	}
+	if hostname == "" {
+		hostname = got(host.Nodename)
+	}
+	if domainname == "" {
+		domainname = got(host.Domainname)
+	}
+	// Writes to /proc/sys end at a newline or NUL byte:
+	if i := strings.IndexAny(domainname, "\n\x00"); i >= 0 {
+		domainname = domainname[:i]
+	}
+	if res.hostnameErr == nil && got(res.uts.Nodename) != hostname {
+		panic(fmt.Sprintf("host name %q was set as %q", hostname, got(res.uts.Nodename)))
+	}
+	if res.domainErr == nil && got(res.uts.Domainname) != domainname {
+		panic(fmt.Sprintf("domain name %q was set as %q", domainname, got(res.uts.Domainname)))
+	}
+	if res.hostnameErr != nil || res.domainErr != nil {
+		return 0
+	}
+	return 1
+}
+
+// additionalGids are entries of the additional groups of a process:
+// group names, gids that are also in the group file, and gids around
+// the limits of the kernel and of uint32.
+var additionalGids = []string{
+	"0", "10", "100", "010", "+10", "-1", "65534", "2147483647", "2147483648",
+	"4294967295", "4294967296", "root", "wheel", "users", "staff", "nonexistent",
+}
+
+// FuzzProcessAdditionalGids resolves the additional groups of a process
+// the way the init process does before calling setgroups(2). Each entry
+// is either a group name or gid in the group file, or a numeric gid,
+// which must be in the range 0-2147483647. The same list must always
+// resolve to the same gids, in the same order, without duplicates.
+func FuzzProcessAdditionalGids(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	groups := []string{}
+	for i := 0; i < n%16; i++ {
+		g, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		switch {
+		case g < len(additionalGids):
+			groups = append(groups, additionalGids[g])
+		case g%2 == 0:
+			var gid struct{ V uint32 }
+			if err := c.GenerateStruct(&gid); err != nil {
+				return -1
+			}
+			groups = append(groups, strconv.FormatUint(uint64(gid.V), 10))
+		default:
+			s, err := c.GetString()
+			if err != nil {
+				return -1
+			}
+			groups = append(groups, s)
+		}
+	}
+	group := "root:x:0:\nwheel:x:10:\nusers:x:100:\nstaff:x:100:\n"
+
+	// Resolve each entry the way the group file is searched:
+	const maxID = 1<<31 - 1
+	expected := make(map[int]bool)
+	outOfRange := false
+	for _, ag := range groups {
+		resolved := false
+		for _, line := range strings.Split(group, "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) < 3 || (fields[0] != ag && fields[2] != ag) {
+				continue
+			}
+			gid, _ := strconv.Atoi(fields[2])
+			expected[gid] = true
+			resolved = true
+			break
+		}
+		if resolved {
+			continue
+		}
+		gid, err := strconv.ParseInt(ag, 10, 64)
+		if err != nil {
+			continue
+		}
+		if gid < 0 || gid > maxID {
+			outOfRange = true
+			continue
+		}
+		expected[int(gid)] = true
+	}
+
+	gids, err := user.GetAdditionalGroups(groups, strings.NewReader(group))
+	if outOfRange {
+		if err == nil {
+			panic(fmt.Sprintf("gids out of range in %q were resolved to %v", groups, gids))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+	if len(groups) == 0 && len(gids) != 0 {
+		panic(fmt.Sprintf("no additional groups resolved to %v", gids))
+	}
+	seen := make(map[int]bool)
+	for _, gid := range gids {
+		if gid < 0 || gid > maxID {
+			panic(fmt.Sprintf("%q resolved to gid %d out of range", groups, gid))
+		}
+		if seen[gid] {
+			panic(fmt.Sprintf("%q resolved to duplicate gid %d: %v", groups, gid, gids))
+		}
+		if !expected[gid] {
+			panic(fmt.Sprintf("%q resolved to unexpected gid %d", groups, gid))
+		}
+		seen[gid] = true
+	}
+	if len(seen) != len(expected) {
+		panic(fmt.Sprintf("%q resolved to %v, expected %d gids", groups, gids, len(expected)))
+	}
+
+	// Resolving again must give the same order:
+	again, err := user.GetAdditionalGroups(groups, strings.NewReader(group))
+	if err != nil {
+		panic(fmt.Sprintf("%q could not be resolved again: %v", groups, err))
+	}
+	if fmt.Sprint(again) != fmt.Sprint(gids) {
+		panic(fmt.Sprintf("%q resolved to %v, then to %v", groups, gids, again))
+	}
+	return 1
+}
+
+// kvmAccesses are the accesses of device rules for /dev/kvm.
+var kvmAccesses = []string{"r", "w", "m", "rw", "rm", "wm", "rwm"}
+
+// kvmAccess replays device rules in order, the way the devices cgroup
+// of cgroup v1 keeps its exceptions, and returns the access they give
+// to /dev/kvm (c 10:232). An exception only changes the exception of
+// the same device, even when it has wildcards.
+func kvmAccess(rules []*devices.Rule) string {
+	type meta struct {
+		major, minor int64
+	}
+	allowAll := false
+	exceptions := make(map[meta]devices.Permissions)
+	for _, r := range rules {
+		if r.Type == devices.WildcardDevice {
+			// Allow or deny all devices:
+			allowAll = r.Allow
+			exceptions = make(map[meta]devices.Permissions)
+			continue
+		}
+		if r.Type != devices.CharDevice || (r.Major != devices.Wildcard && r.Major != 10) ||
+			(r.Minor != devices.Wildcard && r.Minor != 232) {
+			continue
+		}
+		m := meta{r.Major, r.Minor}
+		if r.Allow != allowAll {
+			exceptions[m] = exceptions[m].Union(r.Permissions)
+		} else {
+			exceptions[m] = exceptions[m].Difference(r.Permissions)
+		}
+	}
+	var access devices.Permissions
+	for _, perms := range exceptions {
+		access = access.Union(perms)
+	}
+	if allowAll {
+		access = devices.Permissions("rwm").Difference(access)
+	}
+	var s string
+	for _, p := range "rwm" {
+		if strings.ContainsRune(string(access), p) {
+			s += string(p)
+		}
+	}
+	return s
+}
+
+// FuzzContainerLinuxKvmDevice passes /dev/kvm to a container, possibly
+// more than once, along with device rules for it. runc does not allow
+// the device nodes of the spec in the devices cgroup: without a rule
+// that allows it, only mknod is allowed, by the default rules for all
+// character devices. Both cgroup versions use the same rules, so the
+// rules are checked with the emulator used for cgroup v1. Nothing
+// checks duplicate nodes: the first one is created, the others are
+// ignored. Capabilities do not change the devices of the config.
+func FuzzContainerLinuxKvmDevice(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	nodes := []specs.LinuxDevice{}
+	for i := 0; i < n%4; i++ {
+		var v struct {
+			FileMode uint32
+			UID, GID uint32
+		}
+		if err := c.GenerateStruct(&v); err != nil {
+			return -1
+		}
+		mode := os.FileMode(v.FileMode)
+		nodes = append(nodes, specs.LinuxDevice{
+			Path:     "/dev/kvm",
+			Type:     "c",
+			Major:    10,
+			Minor:    232,
+			FileMode: &mode,
+			UID:      &v.UID,
+			GID:      &v.GID,
+		})
+	}
+	sysAdmin, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	rules := []specs.LinuxDeviceCgroup{}
+	allowed := ""
+	for {
+		kind, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		allow, err := c.GetBool()
+		if err != nil {
+			break
+		}
+		rule := specs.LinuxDeviceCgroup{Allow: allow, Access: "rwm"}
+		if kind%3 != 0 {
+			major := int64(10)
+			rule.Type = "c"
+			rule.Major = &major
+			if kind%3 == 1 {
+				minor := int64(232)
+				rule.Minor = &minor
+			}
+			rule.Access = kvmAccesses[(kind/3)%len(kvmAccesses)]
+		}
+		if allow {
+			allowed += rule.Access
+		}
+		rules = append(rules, rule)
+	}
+
+	rootfs, err := ioutil.TempDir("", "fuzz-kvm")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	spec := &specs.Spec{
+		Root:    &specs.Root{Path: rootfs},
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+		Linux: &specs.Linux{
+			Devices:   nodes,
+			Resources: &specs.LinuxResources{Devices: rules},
+		},
+	}
+	if sysAdmin {
+		caps := []string{"CAP_SYS_ADMIN"}
+		spec.Process.Capabilities = &specs.LinuxCapabilities{Bounding: caps, Effective: caps, Permitted: caps}
+	}
+	config, err := specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+
+	// The devices do not depend on the capabilities:
+	spec.Process.Capabilities = nil
+	refConfig, err := specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("config without capabilities could not be created: %v", err))
+	}
+	if len(config.Devices) != len(refConfig.Devices) || len(config.Cgroups.Resources.Devices) != len(refConfig.Cgroups.Resources.Devices) {
+		panic("devices depend on the capabilities")
+	}
+	for i, d := range config.Devices {
+		if *d != *refConfig.Devices[i] {
+			panic(fmt.Sprintf("device %+v depends on the capabilities", *d))
+		}
+	}
+	for i, r := range config.Cgroups.Resources.Devices {
+		if *r != *refConfig.Cgroups.Resources.Devices[i] {
+			panic(fmt.Sprintf("device rule %+v depends on the capabilities", *r))
+		}
+	}
+
+	// Every /dev/kvm of the spec is a node of the config, in order:
+	kvm := []*devices.Device{}
+	for _, d := range config.Devices {
+		if d.Path == "/dev/kvm" {
+			kvm = append(kvm, d)
+		}
+	}
+	if len(kvm) != len(nodes) {
+		panic(fmt.Sprintf("%d /dev/kvm nodes became %d", len(nodes), len(kvm)))
+	}
+	for i, d := range kvm {
+		if d.Type != devices.CharDevice || d.Major != 10 || d.Minor != 232 ||
+			d.FileMode != *nodes[i].FileMode&^unix.S_IFMT || d.Uid != *nodes[i].UID || d.Gid != *nodes[i].GID {
+			panic(fmt.Sprintf("/dev/kvm %+v became %+v", nodes[i], *d))
+		}
+	}
+
+	// The rules must not allow more than the spec allows, except mknod:
+	expected := kvmAccess(config.Cgroups.Resources.Devices)
+	for _, p := range "rw" {
+		if strings.ContainsRune(expected, p) && !strings.ContainsRune(allowed, p) {
+			panic(fmt.Sprintf("%q access to /dev/kvm is allowed by %+v", p, rules))
+		}
+	}
+	emu := &cgroupdevices.Emulator{}
+	for _, r := range config.Cgroups.Resources.Devices {
+		if err := emu.Apply(*r); err != nil {
+			return 0
+		}
+	}
+	emuRules, err := emu.Rules()
+	if err != nil {
+		return 0
+	}
+	if got := kvmAccess(emuRules); got != expected {
+		panic(fmt.Sprintf("/dev/kvm access is %q, expected %q", got, expected))
+	}
+
+	// Only the first node is created:
+	for _, d := range kvm {
+		if err := createDeviceNode(rootfs, d, false); err != nil {
+			return 0
+		}
+	}
+	if len(kvm) == 0 {
+		return 1
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(rootfs, "dev/kvm"), &st); err != nil {
+		return 0
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != unix.Mkdev(10, 232) ||
+		st.Uid != kvm[0].Uid || st.Gid != kvm[0].Gid {
+		panic(fmt.Sprintf("/dev/kvm %+v was created as %+v", *kvm[0], st))
+	}
+	return 1
+}
+
+// setupMounts are mounts of a container: the filesystems every
+// container needs first, and mounts on top of and beside them.
+var setupMounts = []configs.Mount{
+	{Destination: "/proc", Device: "proc", Source: "proc"},
+	{Destination: "/sys", Device: "sysfs", Source: "sysfs"},
+	{Destination: "/dev", Device: "tmpfs", Source: "tmpfs"},
+	{Destination: "/dev/pts", Device: "devpts", Source: "devpts"},
+	{Destination: "/dev/shm", Device: "tmpfs", Source: "shm"},
+	{Destination: "/dev/mqueue", Device: "mqueue", Source: "mqueue"},
+	{Destination: "/sys/fs/cgroup", Device: "cgroup", Source: "cgroup"},
+	{Destination: "/proc/cpuinfo", Device: "bind"},
+	{Destination: "/proc/net/dev", Device: "bind"},
+	{Destination: "/proc/self/fd", Device: "bind"},
+	{Destination: "/proc/sys", Device: "tmpfs", Source: "tmpfs"},
+	{Destination: "/data/../proc/stat", Device: "bind"},
+	{Destination: "/data", Device: "bind"},
+}
+
+// procBindMounts are the files below /proc that checkProcMount
+// allows to be bind mounted, as lxcfs emulates them.
+var procBindMounts = []string{
+	"/proc/cpuinfo",
+	"/proc/diskstats",
+	"/proc/meminfo",
+	"/proc/stat",
+	"/proc/swaps",
+	"/proc/uptime",
+	"/proc/loadavg",
+	"/proc/slabinfo",
+	"/proc/net/dev",
+}
+
+// FuzzMountNamespaceSetupOrder checks a mount list the way the init
+// process mounts it. runc has no planner: mounts are done in the order
+// of the config, even when a later mount hides an earlier one, and
+// only bind mounts and mounts of unknown types are checked to not be
+// under /proc, apart from the files in procBindMounts.
+func FuzzMountNamespaceSetupOrder(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	rootfs, err := ioutil.TempDir("", "fuzz-mount-order")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+
+	c := gofuzzheaders.NewConsumer(data)
+	config := &configs.Config{Rootfs: rootfs}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		m := setupMounts[i%len(setupMounts)]
+		if m.Device == "bind" {
+			m.Source = rootfs
+		}
+		config.Mounts = append(config.Mounts, &m)
+	}
+	if len(config.Mounts) == 0 {
+		return -1
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+
+	resolve := func(p string) string {
+		dest, err := securejoin.SecureJoin(rootfs, p)
+		if err != nil {
+			panic(fmt.Sprintf("failed to resolve %q: %v", p, err))
+		}
+		return dest
+	}
+	for _, m := range config.Mounts {
+		switch m.Device {
+		case "proc", "sysfs", "mqueue", "tmpfs", "cgroup":
+			continue
+		}
+		dest := resolve(m.Destination)
+		rel, err := filepath.Rel(filepath.Join(rootfs, "/proc"), dest)
+		if err != nil {
+			return 0
+		}
+		allowed := strings.HasPrefix(rel, "..")
+		for _, p := range procBindMounts {
+			if dest == filepath.Join(rootfs, p) {
+				allowed = true
+			}
+		}
+		err = checkProcMount(rootfs, dest, m.Source)
+		if allowed != (err == nil) {
+			panic(fmt.Sprintf("bind mount of %q to %q: allowed: %t, got %v", m.Source, m.Destination, allowed, err))
+		}
+	}
+	return 1
+}
+
+// maxLargeMounts is the highest number of mounts of a container
+// in FuzzContainerLinuxWithLargeMount.
+const maxLargeMounts = 500
+
+// FuzzContainerLinuxWithLargeMount mounts up to maxLargeMounts tmpfs
+// and bind mounts the way the init process does, in a mount namespace
+// that is thrown away. Mounts are done in the order of the config and
+// show up in mountinfo in that order. runc does not unmount anything
+// when a mount fails: the mounts are gone with the mount namespace of
+// the container, so none of them may show up on the host.
+func FuzzContainerLinuxWithLargeMount(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	var n struct{ V uint16 }
+	if err := c.GenerateStruct(&n); err != nil {
+		return -1
+	}
+	count := int(n.V) % (maxLargeMounts + 1)
+	if count == 0 {
+		return -1
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-large-mount")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return -1
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	source := filepath.Join(dir, "source")
+	for _, d := range []string{rootfs, source} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			return -1
+		}
+	}
+
+	config := &configs.Config{Rootfs: rootfs}
+	for i := 0; i < count; i++ {
+		// Use tmpfs mounts once the data runs out:
+		t, err := c.GetInt()
+		if err != nil {
+			t = 0
+		}
+		m := &configs.Mount{
+			Destination: fmt.Sprintf("/m%d", i),
+			Device:      "tmpfs",
+			Source:      "tmpfs",
+		}
+		switch t % 4 {
+		case 1:
+			m.Device = "bind"
+			m.Source = source
+			m.Flags = unix.MS_BIND
+		case 2:
+			if i > 0 {
+				// Nest below one of the previous mounts:
+				m.Destination = filepath.Join(config.Mounts[t%i].Destination, fmt.Sprintf("n%d", i))
+			}
+		case 3:
+			if t%8 == 3 {
+				// The source does not exist:
+				m.Device = "bind"
+				m.Source = filepath.Join(dir, "nonexistent")
+				m.Flags = unix.MS_BIND
+			}
+		}
+		config.Mounts = append(config.Mounts, m)
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+
+	type result struct {
+		mounted    int
+		elapsed    time.Duration
+		parsed     time.Duration
+		mounts     []*mountinfo.Info
+		err        error
+		unshareErr error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); res.unshareErr != nil {
+			return
+		}
+		if res.unshareErr = unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); res.unshareErr != nil {
+			return
+		}
+		start := time.Now()
+		mc := &mountConfig{root: rootfs}
+		for _, m := range config.Mounts {
+			if res.err = mountToRootfs(m, mc); res.err != nil {
+				break
+			}
+			res.mounted++
+		}
+		res.elapsed = time.Since(start)
+
+		f, err := os.Open("/proc/thread-self/mountinfo")
+		if err != nil {
+			res.unshareErr = err
+			return
+		}
+		defer f.Close()
+		start = time.Now()
+		res.mounts, res.unshareErr = mountinfo.GetMountsFromReader(f, mountinfo.PrefixFilter(rootfs))
+		res.parsed = time.Since(start)
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+
+	if res.elapsed > 30*time.Second {
+		panic(fmt.Sprintf("%d mounts took %s", res.mounted, res.elapsed))
+	}
+	if res.parsed > 5*time.Second {
+		panic(fmt.Sprintf("parsing mountinfo with %d mounts took %s", len(res.mounts), res.parsed))
+	}
+	if res.err != nil && config.Mounts[res.mounted].Source != filepath.Join(dir, "nonexistent") {
+		panic(fmt.Sprintf("mount %+v failed: %v", *config.Mounts[res.mounted], res.err))
+	}
+	if len(res.mounts) != res.mounted {
+		panic(fmt.Sprintf("%d mounts were done, mountinfo has %d", res.mounted, len(res.mounts)))
+	}
+	for i, info := range res.mounts {
+		if dest := filepath.Join(rootfs, config.Mounts[i].Destination); info.Mountpoint != dest {
+			panic(fmt.Sprintf("mount %d of %q is at %q in mountinfo", i, dest, info.Mountpoint))
+		}
+	}
+
+	// Nothing may be left mounted on the host. The main thread
+	// may be the one that was thrown away, so /proc/self is not
+	// the mount namespace of this thread:
+	runtime.LockOSThread()
+	f, err := os.Open("/proc/thread-self/mountinfo")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return 0
+	}
+	left, err := mountinfo.GetMountsFromReader(f, mountinfo.PrefixFilter(rootfs))
+	f.Close()
+	runtime.UnlockOSThread()
+	if err != nil {
+		return 0
+	}
+	if len(left) != 0 {
+		panic(fmt.Sprintf("%d mounts are left on the host, first at %q", len(left), left[0].Mountpoint))
+	}
+	if res.err != nil {
+		return 0
+	}
+	return 1
+}
+
+// bindMountSources are sources of bind mounts, relative to a directory
+// that has the rootfs and a host directory with a file in it.
+var bindMountSources = []string{
+	"host", "host/secret", "host/../host/secret", "rootfs/../host", "nonexistent",
+	"host/nonexistent", "rootfs/file", "/proc/kcore", "/dev/null",
+}
+
+// bindMountDestinations are destinations of bind mounts. The rootfs
+// has symlinks to / and to the host directory, and a regular file.
+var bindMountDestinations = []string{
+	"/mnt", "/file", "/a/b/c", "/escape/mnt", "/up/mnt", "/../../mnt", "/proc/kcore", "/proc/cpuinfo",
+}
+
+// threadMounts returns the mounts in the mount namespace of the
+// calling thread.
+func threadMounts() ([]*mountinfo.Info, error) {
+	f, err := os.Open("/proc/thread-self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mountinfo.GetMountsFromReader(f, nil)
+}
+
+// FuzzContainerLinuxBindMountSource does a bind mount the way the init
+// process does, in a mount namespace that is thrown away. The source
+// is a host path and is used as it is: it is not resolved in any root,
+// and files like /proc/kcore are not refused. A source that does not
+// exist fails with ENOENT before anything is mounted. The destination
+// is resolved in the rootfs, so the mount is always inside the rootfs,
+// and it is created as a file or a directory like the source.
+func FuzzContainerLinuxBindMountSource(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	s, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	d, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-bind-source")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return -1
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	for _, p := range []string{rootfs, filepath.Join(dir, "host")} {
+		if err := os.Mkdir(p, 0o755); err != nil {
+			return -1
+		}
+	}
+	for _, p := range []string{filepath.Join(dir, "host/secret"), filepath.Join(rootfs, "file")} {
+		if err := ioutil.WriteFile(p, []byte("fuzz"), 0o644); err != nil {
+			return -1
+		}
+	}
+	if err := os.Symlink("/", filepath.Join(rootfs, "escape")); err != nil {
+		return -1
+	}
+	if err := os.Symlink("../host", filepath.Join(rootfs, "up")); err != nil {
+		return -1
+	}
+
+	source := bindMountSources[s%len(bindMountSources)]
+	if s >= len(bindMountSources) {
+		suffix, err := c.GetString()
+		if err != nil {
+			return -1
+		}
+		source = filepath.Join("host", suffix)
+	}
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(dir, source)
+	}
+	dest := bindMountDestinations[d%len(bindMountDestinations)]
+	if d >= len(bindMountDestinations) {
+		if dest, err = c.GetString(); err != nil {
+			return -1
+		}
+		dest = "/" + dest
+	}
+	m := &configs.Mount{
+		Source:      source,
+		Destination: dest,
+		Device:      "bind",
+		Flags:       unix.MS_BIND | unix.MS_REC,
+	}
+	if err := validate.New().Validate(&configs.Config{Rootfs: rootfs, Mounts: []*configs.Mount{m}}); err != nil {
+		return 0
+	}
+
+	type result struct {
+		err        error
+		mounts     []*mountinfo.Info
+		st         unix.Stat_t
+		unshareErr error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); res.unshareErr != nil {
+			return
+		}
+		if res.unshareErr = unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); res.unshareErr != nil {
+			return
+		}
+		before, err := threadMounts()
+		if err != nil {
+			res.unshareErr = err
+			return
+		}
+		res.err = mountToRootfs(m, &mountConfig{root: rootfs})
+		after, err := threadMounts()
+		if err != nil {
+			res.unshareErr = err
+			return
+		}
+		ids := make(map[int]bool)
+		for _, info := range before {
+			ids[info.ID] = true
+		}
+		for _, info := range after {
+			if !ids[info.ID] {
+				res.mounts = append(res.mounts, info)
+			}
+		}
+		if res.err == nil && len(res.mounts) == 1 {
+			res.err = unix.Stat(res.mounts[0].Mountpoint, &res.st)
+		}
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+
+	// The destination is resolved first:
+	target, err := securejoin.SecureJoin(rootfs, dest)
+	var srcSt unix.Stat_t
+	srcErr := unix.Stat(source, &srcSt)
+	if srcErr == unix.ENOENT && err == nil {
+		if !errors.Is(res.err, unix.ENOENT) {
+			panic(fmt.Sprintf("bind mount of missing source %q did not fail with ENOENT: %v", source, res.err))
+		}
+	}
+	if res.err != nil {
+		if len(res.mounts) != 0 {
+			panic(fmt.Sprintf("failed bind mount of %q to %q left a mount at %q", source, dest, res.mounts[0].Mountpoint))
+		}
+		return 0
+	}
+	if srcErr != nil {
+		panic(fmt.Sprintf("bind mount of %q to %q succeeded: %v", source, dest, srcErr))
+	}
+	if len(res.mounts) != 1 {
+		panic(fmt.Sprintf("bind mount of %q to %q made %d mounts", source, dest, len(res.mounts)))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to resolve %q: %v", dest, err))
+	}
+	if mp := res.mounts[0].Mountpoint; mp != target || (mp != rootfs && !strings.HasPrefix(mp, rootfs+"/")) {
+		panic(fmt.Sprintf("bind mount of %q to %q is at %q, expected %q", source, dest, mp, target))
+	}
+	if res.st.Dev != srcSt.Dev || res.st.Ino != srcSt.Ino || res.st.Mode&unix.S_IFMT != srcSt.Mode&unix.S_IFMT {
+		panic(fmt.Sprintf("bind mount of %q to %q does not show the source", source, dest))
+	}
+	return 1
+}
+
+// Fields of routes: IPv4 and IPv6 destinations, sources and gateways
+// on and off the subnets of eth0, and interfaces that do not exist.
+var (
+	routeDestinations = []string{"0.0.0.0/0", "10.1.0.0/16", "127.0.0.0/8", "10.0.0.0/24", "::/0", "fd01::/64", "10.1.2.3", ""}
+	routeSources      = []string{"10.0.0.2", "fd00::2", "127.0.0.1", "0.0.0.0", ""}
+	routeGateways     = []string{"10.0.0.1", "10.0.0.3", "192.168.1.1", "127.0.0.1", "fd00::1", "fd00::3", "::", ""}
+	routeInterfaces   = []string{"eth0", "lo", "eth1", "nonexistent", ""}
+)
+
+// FuzzContainerLinuxNetworkRoute adds routes the way the init process
+// does, in a network namespace that is thrown away, with a veth pair
+// where eth0 has 10.0.0.2/24 and fd00::2/64. Routes need a source, a
+// gateway and an interface, so there is no route without a gateway.
+// Routes are added in order until one fails, and the ones before it
+// stay. runc has no metric in its routes: a second route to the same
+// destination fails with the EEXIST of the kernel.
+func FuzzContainerLinuxNetworkRoute(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	config := &configs.Config{Rootfs: "/"}
+	for i := 0; i < n%4+1; i++ {
+		var fields [4]string
+		for j, table := range [][]string{routeDestinations, routeSources, routeGateways, routeInterfaces} {
+			k, err := c.GetInt()
+			if err != nil {
+				return -1
+			}
+			fields[j] = table[k%len(table)]
+			if k >= len(table) {
+				if fields[j], err = c.GetString(); err != nil {
+					return -1
+				}
+			}
+		}
+		config.Routes = append(config.Routes, &configs.Route{
+			Destination:   fields[0],
+			Source:        fields[1],
+			Gateway:       fields[2],
+			InterfaceName: fields[3],
+		})
+	}
+	netns, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	if netns {
+		config.Namespaces.Add(configs.NEWNET, "")
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	if !netns {
+		panic("routes were accepted without a network namespace")
+	}
+
+	type result struct {
+		added      int
+		err        error
+		routes     []netlink.Route
+		links      map[string]int
+		unshareErr error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_NEWNET); res.unshareErr != nil {
+			return
+		}
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}, PeerName: "eth1"}
+		if res.unshareErr = netlink.LinkAdd(veth); res.unshareErr != nil {
+			return
+		}
+		res.links = make(map[string]int)
+		for _, name := range []string{"lo", "eth0", "eth1"} {
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				res.unshareErr = err
+				return
+			}
+			res.links[name] = l.Attrs().Index
+			if name == "eth0" {
+				for _, cidr := range []string{"10.0.0.2/24", "fd00::2/64"} {
+					addr, _ := netlink.ParseAddr(cidr)
+					addr.Flags = unix.IFA_F_NODAD
+					if res.unshareErr = netlink.AddrAdd(l, addr); res.unshareErr != nil {
+						return
+					}
+				}
+			}
+			if res.unshareErr = netlink.LinkSetUp(l); res.unshareErr != nil {
+				return
+			}
+		}
+		for _, r := range config.Routes {
+			if res.err = setupRoute(&configs.Config{Routes: []*configs.Route{r}}); res.err != nil {
+				break
+			}
+			res.added++
+		}
+		res.routes, res.unshareErr = netlink.RouteList(nil, netlink.FAMILY_ALL)
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+
+	// Check the routes that were added, and why the next one failed:
+	added := make(map[string]bool)
+	for i, r := range config.Routes[:res.added] {
+		_, dst, _ := net.ParseCIDR(r.Destination)
+		gw := net.ParseIP(r.Gateway)
+		if added[dst.String()] {
+			panic(fmt.Sprintf("second route to %s was accepted: %+v", dst, config.Routes[:i+1]))
+		}
+		added[dst.String()] = true
+		found := false
+		for _, route := range res.routes {
+			if route.LinkIndex != res.links[r.InterfaceName] || !route.Gw.Equal(gw) {
+				continue
+			}
+			if (route.Dst == nil && dst.IP.IsUnspecified()) || (route.Dst != nil && route.Dst.String() == dst.String()) {
+				found = true
+			}
+		}
+		if !found {
+			panic(fmt.Sprintf("route %+v is missing: %+v", *r, res.routes))
+		}
+	}
+	if res.err == nil {
+		return 1
+	}
+	r := config.Routes[res.added]
+	_, dst, dstErr := net.ParseCIDR(r.Destination)
+	switch {
+	case dstErr != nil, net.ParseIP(r.Source) == nil, net.ParseIP(r.Gateway) == nil:
+	case res.links[r.InterfaceName] == 0:
+		// Names that are too long are rejected by the kernel:
+		if _, ok := res.err.(netlink.LinkNotFoundError); !ok && len(r.InterfaceName) < unix.IFNAMSIZ {
+			panic(fmt.Sprintf("route on missing interface %q failed with %v", r.InterfaceName, res.err))
+		}
+	default:
+		for _, prev := range config.Routes[:res.added] {
+			if *prev == *r && !errors.Is(res.err, unix.EEXIST) {
+				panic(fmt.Sprintf("second route to %s failed with %v", dst, res.err))
+			}
+		}
+	}
+	return 0
+}
+
+// execPathDirs are entries of the PATH of a container. The rootfs has
+// an executable prog in /bin and /usr/bin, a prog that is not
+// executable in /sbin, and symlinks to progs in /usr/local/bin.
+var execPathDirs = []string{"/bin", "/usr/bin", "/sbin", "/usr/local/bin", "/nonexistent", "bin", "./usr/bin", "..", "", "/host"}
+
+// execArgs are the first arguments of a process.
+var execArgs = []string{"prog", "/bin/prog", "/sbin/prog", "bin/prog", "./bin/prog", "../../host/prog", "/usr/local/bin/prog", "/host/prog", "link"}
+
+// FuzzContainerLinuxExecPathResolution looks up the binary of a process
+// the way the init process does, after it has moved into the rootfs and
+// set the environment of the process. The lookup is done in a chroot on
+// a thread that is thrown away, so it sees only the rootfs: symlinks
+// and .. are resolved inside it, and the binary next to the rootfs on
+// the host must never be found. An argument with a slash is used as it
+// is, a PATH entry that is not absolute is relative to the cwd, and the
+// first directory of PATH with an executable wins.
+func FuzzContainerLinuxExecPathResolution(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var dirs []string
+	for i := 0; i < n%6; i++ {
+		d, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		dir := execPathDirs[d%len(execPathDirs)]
+		if d >= len(execPathDirs) {
+			if dir, err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	path := strings.Join(dirs, ":")
+	a, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	arg := execArgs[a%len(execArgs)]
+	if a >= len(execArgs) {
+		if arg, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-exec-path")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return -1
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	hostProg := filepath.Join(dir, "host/prog")
+	for _, f := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{hostProg, 0o755},
+		{filepath.Join(rootfs, "bin/prog"), 0o755},
+		{filepath.Join(rootfs, "usr/bin/prog"), 0o755},
+		{filepath.Join(rootfs, "sbin/prog"), 0o644},
+	} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+			return -1
+		}
+		if err := ioutil.WriteFile(f.path, []byte("#!/bin/sh\n"), f.mode); err != nil {
+			return -1
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr/local/bin"), 0o755); err != nil {
+		return -1
+	}
+	// Symlinks to the binary on the host, by its host path and by
+	// a relative path that leaves the rootfs:
+	if err := os.Symlink(hostProg, filepath.Join(rootfs, "usr/local/bin/prog")); err != nil {
+		return -1
+	}
+	if err := os.Symlink("../../../../host/prog", filepath.Join(rootfs, "usr/local/bin/link")); err != nil {
+		return -1
+	}
+	if err := os.Symlink("/usr/bin/prog", filepath.Join(rootfs, "bin/link")); err != nil {
+		return -1
+	}
+	var hostSt unix.Stat_t
+	if err := unix.Stat(hostProg, &hostSt); err != nil {
+		return -1
+	}
+
+	// The environment is set for the whole process:
+	oldPath, hadPath := os.LookupEnv("PATH")
+	defer func() {
+		if hadPath {
+			os.Setenv("PATH", oldPath)
+		} else {
+			os.Unsetenv("PATH")
+		}
+	}()
+
+	type result struct {
+		name       string
+		st         unix.Stat_t
+		err        error
+		envErr     error
+		unshareErr error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_FS); res.unshareErr != nil {
+			return
+		}
+		if res.unshareErr = unix.Chroot(rootfs); res.unshareErr != nil {
+			return
+		}
+		if res.unshareErr = unix.Chdir("/"); res.unshareErr != nil {
+			return
+		}
+		if res.envErr = populateProcessEnvironment([]string{"PATH=" + path}); res.envErr != nil {
+			return
+		}
+		if res.name, res.err = exec.LookPath(arg); res.err != nil {
+			return
+		}
+		res.err = unix.Stat(res.name, &res.st)
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+	if strings.ContainsRune(path, 0) {
+		if res.envErr == nil {
+			panic(fmt.Sprintf("PATH %q with a null byte was accepted", path))
+		}
+		return 0
+	}
+	if res.envErr != nil {
+		panic(fmt.Sprintf("failed to set PATH %q: %v", path, res.envErr))
+	}
+	if res.err == nil && res.st.Dev == hostSt.Dev && res.st.Ino == hostSt.Ino {
+		panic(fmt.Sprintf("%q with PATH %q resolved to the binary on the host", arg, path))
+	}
+
+	// Look the binary up in the rootfs from the host:
+	executable := func(p string) (string, bool) {
+		p, err := securejoin.SecureJoin(rootfs, p)
+		if err != nil {
+			return "", false
+		}
+		fi, err := os.Stat(p)
+		return p, err == nil && fi.Mode().IsRegular() && fi.Mode()&0o111 != 0
+	}
+	var expected string
+	found := false
+	if strings.Contains(arg, "/") {
+		expected, found = executable(arg)
+	} else {
+		for _, d := range filepath.SplitList(path) {
+			if d == "" {
+				d = "."
+			}
+			if expected, found = executable(filepath.Join(d, arg)); found {
+				if !filepath.IsAbs(d) {
+					// Go refuses binaries found through relative entries:
+					if !errors.Is(res.err, exec.ErrDot) {
+						panic(fmt.Sprintf("%q was found in relative PATH entry %q: %q, %v", arg, d, res.name, res.err))
+					}
+					return 0
+				}
+				break
+			}
+		}
+	}
+	if !found {
+		if res.err == nil {
+			panic(fmt.Sprintf("%q with PATH %q was found at %q", arg, path, res.name))
+		}
+		return 0
+	}
+	if res.err != nil {
+		panic(fmt.Sprintf("%q with PATH %q was not found: %v", arg, path, res.err))
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(expected, &st); err != nil || st.Dev != res.st.Dev || st.Ino != res.st.Ino {
+		panic(fmt.Sprintf("%q with PATH %q resolved to %q, expected %q", arg, path, res.name, expected))
+	}
+	return 1
+}
+
+// waitGroupHooks are poststop hooks, run by sh -c.
+var waitGroupHooks = []string{"true", "exit 1", "cat", "sleep 2"}
+
+// FuzzContainerLinuxWaitGroup creates a container in a new memory
+// cgroup, asks for OOM and memory pressure notifications and destroys
+// the container, which runs its poststop hooks. Every goroutine that
+// was started has to be gone within 5 seconds: the notifications end
+// when the cgroup is removed, and hooks are waited for or killed when
+// they time out. Starting the container needs runc init, which the
+// fuzzer does not have, so the goroutines of Start are not covered.
+func FuzzContainerLinuxWaitGroup(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	if cgroups.IsCgroup2UnifiedMode() {
+		// The v2 notifications only end when the cgroup is empty:
+		return -1
+	}
+	c := gofuzzheaders.NewConsumer(data)
+	oom, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	level, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	hooks := configs.Hooks{}
+	for {
+		h, err := c.GetInt()
+		if err != nil || len(hooks[configs.Poststop]) == 3 {
+			break
+		}
+		cmd := configs.Command{
+			Path: "/bin/sh",
+			Args: []string{"sh", "-c", waitGroupHooks[h%len(waitGroupHooks)]},
+		}
+		if t := (h / len(waitGroupHooks)) % 3; t != 0 {
+			timeout := time.Duration(t) * time.Second
+			cmd.Timeout = &timeout
+		}
+		hooks[configs.Poststop] = append(hooks[configs.Poststop], configs.NewCommandHook(cmd))
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-waitgroup")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	before := runtime.NumGoroutine()
+
+	config := &configs.Config{
+		Rootfs: root,
+		Namespaces: configs.Namespaces{
+			{Type: configs.NEWNS},
+			{Type: configs.NEWPID},
+		},
+		Cgroups: &configs.Cgroup{
+			Path:      "/" + filepath.Base(root),
+			Resources: &configs.Resources{},
+		},
+		Hooks: hooks,
+	}
+	f, err := New(filepath.Join(root, "state"), Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Create("fuzz", config)
+	if err != nil {
+		return 0
+	}
+	lc := container.(*linuxContainer)
+	if err := lc.cgroupManager.Apply(-1); err != nil {
+		_ = container.Destroy()
+		return 0
+	}
+	var channels []<-chan struct{}
+	if oom {
+		if ch, err := container.NotifyOOM(); err == nil {
+			channels = append(channels, ch)
+		}
+	}
+	if level%5 < 4 {
+		if ch, err := container.NotifyMemoryPressure(PressureLevel(level % 5)); err == nil {
+			channels = append(channels, ch)
+		}
+	}
+
+	_ = container.Destroy()
+	for _, ch := range channels {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			panic("notification channel was not closed after the container was destroyed")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			panic(fmt.Sprintf("%d goroutines are left after the container was destroyed:\n%s", runtime.NumGoroutine()-before, buf))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 1
+}
+
+// fdInitEnv is set to an initConfig when the fuzzer is re-executed
+// as a stand-in for the init process of FuzzContainerLinuxFDCloseExec.
+const fdInitEnv = "_FUZZ_FD_INIT_CONFIG"
+
+// init does what the init process does with its file descriptors
+// before it executes the container process: everything after stdio
+// and the passed files is marked close-on-exec. It then checks the
+// flags and executes ls on /proc/self/fd.
+func init() {
+	b := os.Getenv(fdInitEnv)
+	if b == "" {
+		return
+	}
+	config := &initConfig{}
+	if err := json.Unmarshal([]byte(b), config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	minFd := config.PassedFilesCount + 3
+	if err := utils.CloseExecFrom(minFd); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, f := range fds {
+		fd, err := strconv.Atoi(f.Name())
+		if err != nil || fd < minFd {
+			continue
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		if err == nil && flags&unix.FD_CLOEXEC == 0 {
+			fmt.Fprintf(os.Stderr, "fd %d is not close-on-exec\n", fd)
+			os.Exit(2)
+		}
+	}
+	ls, err := exec.LookPath("ls")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = unix.Exec(ls, []string{"ls", "/proc/self/fd"}, os.Environ())
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// FuzzContainerLinuxFDCloseExec starts a stand-in init process with
+// the passed files as ExtraFiles, followed by files that were leaked
+// to it and must not reach the container. PassedFilesCount is the
+// number of passed files, as in newInitConfig(), so after the exec
+// only stdio and the passed files may be open, plus the one ls opens
+// /proc/self/fd with, which gets the lowest free file descriptor.
+func FuzzContainerLinuxFDCloseExec(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	passed, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	leaked, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	passed %= 8
+	leaked %= 8
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for len(files) < passed+leaked {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return -1
+		}
+		files = append(files, r, w)
+	}
+	files = files[:passed+leaked]
+
+	b, err := json.Marshal(&initConfig{PassedFilesCount: passed})
+	if err != nil {
+		return -1
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), fdInitEnv+"="+string(b))
+	cmd.ExtraFiles = files
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 2 {
+		panic(fmt.Sprintf("%d passed and %d leaked files: %s", passed, leaked, stderr.String()))
+	}
+	if err != nil {
+		return 0
+	}
+
+	var fds []int
+	for _, name := range strings.Fields(string(out)) {
+		fd, err := strconv.Atoi(name)
+		if err != nil {
+			panic(fmt.Sprintf("unexpected entry %q in /proc/self/fd", name))
+		}
+		fds = append(fds, fd)
+	}
+	sort.Ints(fds)
+	expected := make([]int, passed+4)
+	for fd := range expected {
+		expected[fd] = fd
+	}
+	if !reflect.DeepEqual(fds, expected) {
+		panic(fmt.Sprintf("%d passed and %d leaked files: expected fds %d, got %d", passed, leaked, expected, fds))
+	}
+	return 1
+}
+
+// mountDataOptions are filesystem specific options of a mount,
+// including unknown options, empty options and a NUL byte.
+var mountDataOptions = []string{
+	"", "size=1k", "mode=700", "nr_inodes=2,mode=700", "mode=700,,size=1k", ",", "a,b", "mode=700\x00size=1k",
+	"errors=remount-ro", "data=ordered",
+}
+
+// mountDataDevices are filesystem types to mount with the data.
+var mountDataDevices = []string{"tmpfs", "ext4"}
+
+// FuzzContainerLinuxMountDataOption mounts a filesystem with fuzzed
+// data the way the init process does, in a mount namespace that is
+// thrown away. The data can be padded with empty options. Data with a
+// NUL byte cannot be passed to mount(2) and has to fail. ext4 needs a
+// block device, which the source never is.
+//
+// runc does not limit the length of the data, and the kernel silently
+// drops whatever does not fit in the page it copies the data into, so
+// a mount with a page of data or more is mounted without its last
+// options. That is known, and such data is skipped.
+func FuzzContainerLinuxMountDataOption(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	d, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	t, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	p, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	mountData := mountDataOptions[d%len(mountDataOptions)]
+	if d >= len(mountDataOptions) {
+		if mountData, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+	// Pad with up to three quarters of a page of empty options:
+	mountData = strings.Repeat(",", (p%4)*os.Getpagesize()/4) + mountData
+	if len(mountData) >= os.Getpagesize() {
+		return -1
+	}
+	device := mountDataDevices[t%len(mountDataDevices)]
+
+	dir, err := ioutil.TempDir("", "fuzz-mount-data")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return -1
+	}
+	m := &configs.Mount{
+		Destination: "/mnt",
+		Device:      device,
+		Source:      device,
+		Data:        mountData,
+	}
+
+	type result struct {
+		mounts     []*mountinfo.Info
+		err        error
+		unshareErr error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.unshareErr = unix.Unshare(unix.CLONE_NEWNS | unix.CLONE_FS); res.unshareErr != nil {
+			return
+		}
+		if res.unshareErr = unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); res.unshareErr != nil {
+			return
+		}
+		res.err = mountToRootfs(m, &mountConfig{root: dir})
+		f, err := os.Open("/proc/thread-self/mountinfo")
+		if err != nil {
+			res.unshareErr = err
+			return
+		}
+		defer f.Close()
+		res.mounts, res.unshareErr = mountinfo.GetMountsFromReader(f, mountinfo.PrefixFilter(dir))
+	}()
+	res := <-resCh
+	if res.unshareErr != nil {
+		return 0
+	}
+
+	if res.err != nil {
+		if len(res.mounts) != 0 {
+			panic(fmt.Sprintf("%s with data %q failed, but is mounted: %v", device, mountData, res.err))
+		}
+		return 0
+	}
+	if strings.Contains(mountData, "\x00") {
+		panic(fmt.Sprintf("%s with data %q was mounted", device, mountData))
+	}
+	if len(res.mounts) != 1 || res.mounts[0].Mountpoint != filepath.Join(dir, "mnt") || res.mounts[0].FSType != device {
+		panic(fmt.Sprintf("%s with data %q was mounted %d times", device, mountData, len(res.mounts)))
+	}
+	if device == "ext4" {
+		panic(fmt.Sprintf("ext4 from %q was mounted with data %q", m.Source, mountData))
+	}
+	return 1
+}
+
+// initSyncMessages are messages a stand-in init process sends on the
+// sync pipe before it hangs or exits.
+var initSyncMessages = []string{
+	`{"type":"procReady"}`,
+	`{"type":"procHooks"}`,
+	`{"type":"procError"}{"message":"init failed"}`,
+	`{"type":"procRun"}`,
+	`{"type":"unknown"}`,
+	`{"type":`,
+	`{}`,
+}
+
+// FuzzContainerLinuxWithTimeoutedInit runs the parent side of the
+// sync protocol of initProcess.start() against a stand-in init process
+// that sends some messages and then hangs or exits after a delay. runc
+// has no timeout of its own: it only notices that the init process is
+// gone when the sync pipe is closed, so the caller has to kill it. The
+// kill after the timeout and the exit of the init process may happen
+// at about the same time. Either way the parent has to stop reading,
+// the setup has to fail unless procRun was sent, and the init process
+// has to be reaped.
+func FuzzContainerLinuxWithTimeoutedInit(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	hang, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	t, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	d, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	timeout := time.Duration(t) * 2 * time.Millisecond
+	delay := time.Duration(d) * 2 * time.Millisecond
+	var messages []string
+	for len(messages) < 8 {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		m := initSyncMessages[i%len(initSyncMessages)]
+		if i >= len(initSyncMessages) {
+			if m, err = c.GetString(); err != nil {
+				break
+			}
+		}
+		messages = append(messages, m)
+	}
+
+	parent, child, err := utils.NewSockPair("init")
+	if err != nil {
+		return -1
+	}
+	defer parent.Close()
+
+	// The init process execs sleep, so that no other process
+	// keeps the sync pipe open once it is killed:
+	script := ""
+	env := os.Environ()
+	for i, m := range messages {
+		script += fmt.Sprintf(`printf '%%s' "$_FUZZ_SYNC_%d" >&3; `, i)
+		env = append(env, fmt.Sprintf("_FUZZ_SYNC_%d=%s", i, m))
+		// Read the reply, as unread data resets the connection:
+		reply := map[string]syncType{initSyncMessages[0]: procRun, initSyncMessages[1]: procResume}[m]
+		if reply != "" {
+			script += fmt.Sprintf("dd bs=1 count=%d <&3 >/dev/null 2>&1; ", len(`{"type":""}`)+len(reply))
+		}
+	}
+	if hang {
+		script += "exec sleep 1000"
+	} else {
+		script += fmt.Sprintf("exec sleep %.3f", delay.Seconds())
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = env
+	cmd.ExtraFiles = []*os.File{child}
+	if err := cmd.Start(); err != nil {
+		child.Close()
+		return -1
+	}
+	child.Close()
+	pid := cmd.Process.Pid
+	timer := time.AfterFunc(timeout, func() {
+		_ = cmd.Process.Kill()
+	})
+	defer timer.Stop()
+
+	var sentRun bool
+	var sent []syncType
+	ierrCh := make(chan error, 1)
+	go func() {
+		ierrCh <- parseSync(parent, func(sync *syncT) error {
+			switch sync.Type {
+			case procReady:
+				if err := writeSync(parent, procRun); err != nil {
+					return newSystemErrorWithCause(err, "writing syncT 'run'")
+				}
+				sentRun = true
+			case procHooks:
+				if err := writeSync(parent, procResume); err != nil {
+					return newSystemErrorWithCause(err, "writing syncT 'resume'")
+				}
+			default:
+				return newSystemError(errors.New("invalid JSON payload from child"))
+			}
+			sent = append(sent, sync.Type)
+			return nil
+		})
+	}()
+	var ierr error
+	select {
+	case ierr = <-ierrCh:
+	case <-time.After(timeout + delay + 10*time.Second):
+		_ = cmd.Process.Kill()
+		panic(fmt.Sprintf("parent still reads the sync pipe %s after the init process (pid %d) should be gone", timeout+delay, pid))
+	}
+
+	// This is what initProcess.start() and its caller do:
+	err = ierr
+	if !sentRun {
+		err = newSystemErrorWithCause(ierr, "container init")
+	}
+	if err != nil || hang {
+		_ = cmd.Process.Kill()
+	}
+	state, werr := cmd.Process.Wait()
+	if werr != nil {
+		panic(fmt.Sprintf("failed to wait for the init process (pid %d): %v", pid, werr))
+	}
+	if _, serr := os.Stat(fmt.Sprintf("/proc/%d", pid)); serr == nil {
+		if b, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); strings.Contains(string(b), ") Z ") {
+			panic(fmt.Sprintf("init process %d is a zombie after it was waited for", pid))
+		}
+	}
+
+	ready := false
+	for _, m := range messages {
+		if strings.HasPrefix(m, `{"type":"procReady"}`) {
+			ready = true
+		}
+	}
+	if !ready && err == nil {
+		panic(fmt.Sprintf("setup succeeded without procReady from the init process (%s): %q", state, messages))
+	}
+	if hang && state.Success() {
+		panic(fmt.Sprintf("hung init process was not killed: %s", state))
+	}
+	if err != nil {
+		if err.Error() == "" {
+			panic(fmt.Sprintf("error without reason after %q", messages))
+		}
+		return 0
+	}
+	for _, s := range sent {
+		if s != procReady && s != procHooks {
+			panic(fmt.Sprintf("unexpected sync %q was handled", s))
+		}
+	}
+	return 1
+}
+
+// syncPidMessages are messages with the pids of the init process,
+// which the parent reads before the sync messages.
+var syncPidMessages = []string{
+	`{"stage2_pid":100,"stage1_pid":99}`,
+	`{"stage2_pid":8080}`,
+	`{"stage2_pid":"100","stage1_pid":99}`,
+	`{"stage2_pid":-1,"stage1_pid":0}`,
+	`{"stage2_pid":1e3}`,
+	`{"stage2_pid":100,"stage1_pid":99`,
+	`{}`,
+	`null`,
+}
+
+// syncPipeMessages are sync messages besides initSyncMessages: ones
+// with fields runc does not know, and errors with a bad payload.
+var syncPipeMessages = []string{
+	`{"type":"procReady","pid":8080}`,
+	`{"type":"procHooks","type":"procReady"}`,
+	`{"type":"procError"}{"ECode":"x"}`,
+	`{"type":"procError"}{"message":"init failed"}{"type":"procReady"}`,
+	`{"type":"procError"}null`,
+}
+
+// FuzzContainerLinuxSyncPipe sends the pid and sync messages of an
+// init process over a net.Pipe() and parses them the way the parent
+// does: the pids are decoded like getChildPid() does and the rest is
+// handled by parseSync(), which replies to procReady and procHooks on
+// a second pipe. The messages are written one by one or all at once.
+// Parsing must not panic or hang, and every message up to the first
+// one that is not procReady or procHooks must be handled in order,
+// also when the pids arrived in the same write.
+func FuzzContainerLinuxSyncPipe(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	batch, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	p, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	pidMessage := syncPidMessages[p%len(syncPidMessages)]
+	table := append(append([]string{}, initSyncMessages...), syncPipeMessages...)
+	known := true
+	var messages []string
+	for len(messages) < 16 {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		m := table[i%len(table)]
+		if i >= len(table) {
+			if m, err = c.GetString(); err != nil {
+				break
+			}
+			known = false
+		}
+		messages = append(messages, m)
+	}
+
+	// net.Pipe() is not buffered, so the replies go
+	// over a second pipe that is read all the time:
+	parentR, childW := net.Pipe()
+	childR, parentW := net.Pipe()
+	defer parentR.Close()
+	defer parentW.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, childR)
+	}()
+	go func() {
+		defer childW.Close()
+		if batch {
+			_, _ = childW.Write([]byte(pidMessage + strings.Join(messages, "")))
+			return
+		}
+		for _, m := range append([]string{pidMessage}, messages...) {
+			if _, err := childW.Write([]byte(m)); err != nil {
+				return
+			}
+		}
+	}()
+
+	type result struct {
+		pid     pid
+		pidErr  error
+		handled []syncType
+		err     error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		if res.pidErr = json.NewDecoder(parentR).Decode(&res.pid); res.pidErr != nil {
+			return
+		}
+		res.err = parseSync(parentR, func(sync *syncT) error {
+			switch sync.Type {
+			case procReady:
+				if err := writeSync(parentW, procRun); err != nil {
+					return newSystemErrorWithCause(err, "writing syncT 'run'")
+				}
+			case procHooks:
+				if err := writeSync(parentW, procResume); err != nil {
+					return newSystemErrorWithCause(err, "writing syncT 'resume'")
+				}
+			default:
+				return newSystemError(errors.New("invalid JSON payload from child"))
+			}
+			res.handled = append(res.handled, sync.Type)
+			return nil
+		})
+	}()
+	var res result
+	select {
+	case res = <-resCh:
+	case <-time.After(10 * time.Second):
+		panic(fmt.Sprintf("parsing %q and %q hangs", pidMessage, messages))
+	}
+	if res.pidErr != nil || !known {
+		return 0
+	}
+
+	var expected []syncType
+	complete := true
+	for _, m := range messages {
+		var sync syncT
+		if err := json.Unmarshal([]byte(m), &sync); err != nil || (sync.Type != procReady && sync.Type != procHooks) {
+			complete = false
+			break
+		}
+		expected = append(expected, sync.Type)
+	}
+	if len(res.handled) != len(expected) {
+		panic(fmt.Sprintf("after pids %+v, expected %q to be handled, got %q (batch %t): %v", res.pid, expected, res.handled, batch, res.err))
+	}
+	for i, t := range res.handled {
+		if t != expected[i] {
+			panic(fmt.Sprintf("message %d: expected %q, got %q", i, expected[i], t))
+		}
+	}
+	if complete != (res.err == nil) {
+		panic(fmt.Sprintf("messages %q were parsed with error %v", messages, res.err))
+	}
+	return 1
+}
+
+// netnsPids are the pid components of /proc/<pid>/ns/<type> paths.
+// "zombie" is replaced by the pid of a zombie process and "pid" by
+// the pid of the fuzzer.
+var netnsPids = []string{"0", "1", "self", "thread-self", "pid", "zombie", "4194305", "99999999999999999999", "-1", "01"}
+
+// netnsComponents are components between the pid and "ns".
+var netnsComponents = []string{"", "/.", "/task/..", "/../self", "/task", "//"}
+
+// netnsTypes are the namespace types of the paths.
+var netnsTypes = []string{"net", "mnt", "uts", "ipc", "pid", "user", "cgroup", "", "net/"}
+
+// FuzzContainerLinuxNetNsPath joins a network namespace through a
+// fuzzed /proc/<pid>/ns/<type> path. Before the init process is
+// started runc only checks that the path exists; nsexec then opens it
+// and calls setns(2) with CLONE_NEWNET. A zombie process has no
+// namespaces left, so its path exists but cannot be opened, and a
+// namespace of another type is rejected by setns(2) with EINVAL. The
+// path must never be joined as anything but a network namespace.
+func FuzzContainerLinuxNetNsPath(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	p, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	m, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	t, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	pid := netnsPids[p%len(netnsPids)]
+	if p >= len(netnsPids) {
+		if pid, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+	switch pid {
+	case "pid":
+		pid = strconv.Itoa(os.Getpid())
+	case "zombie":
+		cmd := exec.Command("true")
+		if err := cmd.Start(); err != nil {
+			return -1
+		}
+		defer cmd.Wait()
+		pid = strconv.Itoa(cmd.Process.Pid)
+		for i := 0; i < 100; i++ {
+			b, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+			if err == nil && strings.Contains(string(b), ") Z ") {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	path := "/proc/" + pid + netnsComponents[m%len(netnsComponents)] + "/ns/" + netnsTypes[t%len(netnsTypes)]
+
+	rootfs, err := ioutil.TempDir("", "fuzz-netns-path")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	config := &configs.Config{Rootfs: rootfs}
+	config.Namespaces.Add(configs.NEWNET, path)
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+	container := &linuxContainer{config: config}
+	if _, err := container.orderNamespacePaths(map[configs.NamespaceType]string{configs.NEWNET: path}); err != nil {
+		if _, lerr := os.Lstat(path); lerr == nil {
+			panic(fmt.Sprintf("existing namespace path %q was rejected: %v", path, err))
+		}
+		return 0
+	}
+
+	// This is what nsexec does, on a thread that is thrown away:
+	type result struct {
+		link     string
+		openErr  error
+		setnsErr error
+		joined   string
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			resCh <- res
+		}()
+		res.link, _ = os.Readlink(path)
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			res.openErr = err
+			return
+		}
+		defer unix.Close(fd)
+		if res.setnsErr = unix.Setns(fd, unix.CLONE_NEWNET); res.setnsErr != nil {
+			return
+		}
+		res.joined, _ = os.Readlink("/proc/thread-self/ns/net")
+	}()
+	res := <-resCh
+
+	if res.openErr != nil {
+		if pid == "0" || pid == "4194305" {
+			panic(fmt.Sprintf("%q exists, but cannot be opened: %v", path, res.openErr))
+		}
+		return 0
+	}
+	if !strings.HasPrefix(res.link, "net:[") {
+		if res.setnsErr == nil {
+			panic(fmt.Sprintf("%q (%q) was joined as network namespace %q", path, res.link, res.joined))
+		}
+		if !errors.Is(res.setnsErr, unix.EINVAL) {
+			panic(fmt.Sprintf("joining %q (%q) failed with %v instead of EINVAL", path, res.link, res.setnsErr))
+		}
+		return 0
+	}
+	if res.setnsErr != nil {
+		panic(fmt.Sprintf("failed to join network namespace %q (%q): %v", path, res.link, res.setnsErr))
+	}
+	if res.joined != res.link {
+		panic(fmt.Sprintf("joining %q (%q) ended up in %q", path, res.link, res.joined))
+	}
+	return 1
+}
+
+// parentPid returns the PPid from /proc/<pid>/status.
+func parentPid(pid int) (int, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v := strings.TrimPrefix(line, "PPid:"); v != line {
+			return strconv.Atoi(strings.TrimSpace(v))
+		}
+	}
+	return 0, fmt.Errorf("no PPid in /proc/%d/status", pid)
+}
+
+// FuzzContainerLinuxWithSubreaper puts a shell in the cgroup of a
+// container that starts a few children and exits, leaving them as
+// orphans, like runc does with a detached container when it is the
+// child subreaper. The orphans are what Processes returns, and they
+// are reparented to the fuzzer only if it is the subreaper. Signalling
+// all processes, the way Signal and Destroy do, must then leave them
+// to the subreaper to be collected with waitpid, and must not reap
+// the children of the fuzzer that are outside of the cgroup.
+func FuzzContainerLinuxWithSubreaper(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	subreaper, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	orphans, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	outside, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	kill, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	sig := unix.SIGTERM
+	if kill {
+		sig = unix.SIGKILL
+	}
+
+	prev, err := system.GetSubreaper()
+	if err != nil {
+		return -1
+	}
+	defer system.SetSubreaper(prev) //nolint:errcheck
+	flag := 0
+	if subreaper {
+		flag = 1
+	}
+	if err := system.SetSubreaper(flag); err != nil {
+		return -1
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-subreaper")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	config := &configs.Config{
+		Rootfs: root,
+		Cgroups: &configs.Cgroup{
+			Path:      "/" + filepath.Base(root),
+			Resources: &configs.Resources{},
+		},
+	}
+	f, err := New(filepath.Join(root, "state"), Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Create("fuzz", config)
+	if err != nil {
+		return 0
+	}
+	defer container.Destroy() //nolint:errcheck
+	lc := container.(*linuxContainer)
+
+	// Children of the fuzzer outside of the container's cgroup:
+	others := map[int]*exec.Cmd{}
+	defer func() {
+		for _, cmd := range others {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	}()
+	for i := 0; i < outside%3; i++ {
+		cmd := exec.Command("sleep", "1000")
+		if err := cmd.Start(); err != nil {
+			return -1
+		}
+		others[cmd.Process.Pid] = cmd
+	}
+
+	// The shell waits until it is in the cgroup before it forks:
+	n := orphans % 4
+	script := fmt.Sprintf("read x; i=0; while [ $i -lt %d ]; do sleep 1000 & i=$((i+1)); done", n)
+	cmd := exec.Command("sh", "-c", script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return -1
+	}
+	if err := cmd.Start(); err != nil {
+		return -1
+	}
+	if err := lc.cgroupManager.Apply(cmd.Process.Pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		panic(fmt.Sprintf("container process failed: %v", err))
+	}
+
+	pids, err := container.Processes()
+	if err != nil {
+		panic(fmt.Sprintf("failed to get the processes of the container: %v", err))
+	}
+	if len(pids) != n {
+		panic(fmt.Sprintf("expected %d orphans in the container, got %v", n, pids))
+	}
+	for _, pid := range pids {
+		if _, ok := others[pid]; ok {
+			panic(fmt.Sprintf("process %d outside of the cgroup is listed as a container process", pid))
+		}
+		ppid, err := parentPid(pid)
+		if err != nil {
+			panic(fmt.Sprintf("orphan %d is gone: %v", pid, err))
+		}
+		if subreaper != (ppid == os.Getpid()) {
+			panic(fmt.Sprintf("orphan %d was reparented to %d, subreaper is %v", pid, ppid, subreaper))
+		}
+	}
+
+	if err := signalAllProcesses(lc.cgroupManager, sig); err != nil {
+		panic(fmt.Sprintf("failed to signal the processes of the container: %v", err))
+	}
+	if subreaper {
+		for _, pid := range pids {
+			var ws unix.WaitStatus
+			if _, err := unix.Wait4(pid, &ws, 0, nil); err != nil {
+				panic(fmt.Sprintf("orphan %d was not left to the subreaper: %v", pid, err))
+			}
+			if !ws.Signaled() || ws.Signal() != sig {
+				panic(fmt.Sprintf("orphan %d exited with %v instead of %v", pid, ws, sig))
+			}
+		}
+	}
+	for pid := range others {
+		var ws unix.WaitStatus
+		wpid, err := unix.Wait4(pid, &ws, unix.WNOHANG, nil)
+		if err != nil || wpid != 0 {
+			panic(fmt.Sprintf("process %d outside of the cgroup was reaped: %d, %v", pid, wpid, err))
+		}
+	}
+	return 1
+}
+
+// hugetlbInitEnv is set to a hugetlbInit when the fuzzer is re-executed
+// as the container process of FuzzContainerLinuxWithHugePageTlbSharing.
+const hugetlbInitEnv = "_FUZZ_HUGETLB_INIT"
+
+// hugetlbInit is what the container process does: map and touch Pages
+// huge pages of PageSize bytes, then touch transparent huge pages,
+// optionally with madvise(MADV_HUGEPAGE).
+type hugetlbInit struct {
+	Pages    int
+	PageSize int
+	Madvise  bool
+}
+
+// hugetlbResult is what the container process reports back.
+type hugetlbResult struct {
+	MmapErr       string
+	AnonHugePages uint64
+}
+
+// thpSize is the size of the memory touched as transparent huge pages.
+const thpSize = 8 << 20
+
+// init waits until it was put into the cgroup of the container, maps
+// the huge pages and then the transparent huge pages. A fault over the
+// hugetlb limit kills it with SIGBUS. The result is written to stdout,
+// after which it keeps all of its memory until stdin is closed.
+func init() {
+	b := os.Getenv(hugetlbInitEnv)
+	if b == "" {
+		return
+	}
+	config := &hugetlbInit{}
+	if err := json.Unmarshal([]byte(b), config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	buf := make([]byte, 1)
+	if _, err := os.Stdin.Read(buf); err != nil {
+		os.Exit(1)
+	}
+
+	var res hugetlbResult
+	if config.Pages > 0 {
+		shift := 0
+		for 1<<shift < config.PageSize {
+			shift++
+		}
+		mem, err := unix.Mmap(-1, 0, config.Pages*config.PageSize, unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_HUGETLB|shift<<unix.MAP_HUGE_SHIFT)
+		if err != nil {
+			res.MmapErr = err.Error()
+		} else {
+			for i := 0; i < len(mem); i += config.PageSize {
+				mem[i] = 1
+			}
+		}
+	}
+	mem, err := unix.Mmap(-1, 0, thpSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if config.Madvise {
+		if err := unix.Madvise(mem, unix.MADV_HUGEPAGE); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for i := 0; i < len(mem); i += os.Getpagesize() {
+		mem[i] = 1
+	}
+	smaps, err := ioutil.ReadFile("/proc/self/smaps_rollup")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, line := range strings.Split(string(smaps), "\n") {
+		if v := strings.TrimPrefix(line, "AnonHugePages:"); v != line {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			res.AnonHugePages = kb << 10
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(&res); err != nil {
+		os.Exit(1)
+	}
+	_, _ = io.Copy(ioutil.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+// hugetlbPageSizes are huge page sizes as runc names them, whether or
+// not the system has them.
+var hugetlbPageSizes = []string{"2MB", "1GB", "64KB", "32MB", "16GB"}
+
+// hugePageBytes returns the size of a huge page named like "2MB".
+func hugePageBytes(pagesize string) int {
+	n, _ := strconv.Atoi(pagesize[:len(pagesize)-2])
+	switch pagesize[len(pagesize)-2:] {
+	case "KB":
+		return n << 10
+	case "MB":
+		return n << 20
+	}
+	return n << 30
+}
+
+// FuzzContainerLinuxWithHugePageTlbSharing sets a hugetlb limit on a
+// new cgroup, puts a container process in it and lets it map huge
+// pages and touch transparent huge pages. A limit for a page size the
+// system does not have, or without a hugetlb controller, has to make
+// Set fail with an error that names hugetlb. Mapping more huge pages
+// than are free has to fail with ENOMEM, as the pages are reserved by
+// mmap, and so should mapping more than the limit, but the limit is
+// only charged when a page is faulted in, which kills the process
+// with SIGBUS. Transparent huge pages are never charged to hugetlb, so
+// a limit of 0 does not stop them, but there must not be any when they
+// are disabled, or only enabled for madvise and there was none.
+func FuzzContainerLinuxWithHugePageTlbSharing(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	limitIdx, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	pagesIdx, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	madvise, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	pagesize := hugetlbPageSizes[i%len(hugetlbPageSizes)]
+	size := hugePageBytes(pagesize)
+
+	// Systems without huge pages do not have this directory:
+	sizes, _ := cgroups.GetHugePageSize()
+	available := false
+	for _, s := range sizes {
+		available = available || s == pagesize
+	}
+	free := 0
+	if available {
+		b, err := ioutil.ReadFile(fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB/free_hugepages", size>>10))
+		if err != nil {
+			return -1
+		}
+		if free, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return -1
+		}
+	}
+	thp := "never"
+	if b, err := ioutil.ReadFile("/sys/kernel/mm/transparent_hugepage/enabled"); err == nil {
+		if s := strings.SplitN(string(b), "[", 2); len(s) == 2 {
+			thp = strings.SplitN(s[1], "]", 2)[0]
+		}
+	}
+
+	r := &configs.Resources{}
+	limitPages := -1
+	switch limitIdx % 5 {
+	case 1:
+		limitPages = 0
+	case 2:
+		limitPages = 1
+	case 3:
+		limitPages = free
+	case 4:
+		limitPages = free + 1
+	}
+	if limitPages >= 0 {
+		r.HugetlbLimit = []*configs.HugepageLimit{{Pagesize: pagesize, Limit: uint64(limitPages * size)}}
+	}
+	pages := []int{0, 1, free, free + 1}[pagesIdx%4]
+	if !available {
+		pages = 0
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-hugetlb")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	config := &configs.Config{
+		Rootfs: root,
+		Cgroups: &configs.Cgroup{
+			Path:      "/" + filepath.Base(root),
+			Resources: r,
+		},
+	}
+	f, err := New(filepath.Join(root, "state"), Cgroupfs)
+	if err != nil {
+		return -1
+	}
+	container, err := f.Create("fuzz", config)
+	if err != nil {
+		return 0
+	}
+	defer container.Destroy() //nolint:errcheck
+	lc := container.(*linuxContainer)
+
+	b, err := json.Marshal(&hugetlbInit{Pages: pages, PageSize: size, Madvise: madvise})
+	if err != nil {
+		return -1
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), hugetlbInitEnv+"="+string(b))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return -1
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1
+	}
+	if err := cmd.Start(); err != nil {
+		return -1
+	}
+	defer func() {
+		stdin.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	if err := lc.cgroupManager.Apply(cmd.Process.Pid); err != nil {
+		return 0
+	}
+	controller := lc.cgroupManager.Path("hugetlb") != ""
+	if cgroups.IsCgroup2UnifiedMode() {
+		controllers, err := cgroups.ReadFile(lc.cgroupManager.Path(""), "cgroup.controllers")
+		controller = err == nil && strings.Contains(" "+strings.TrimSpace(controllers)+" ", " hugetlb ")
+	}
+	err = lc.cgroupManager.Set(r)
+	if limitPages >= 0 && (!available || !controller) {
+		if err == nil {
+			panic(fmt.Sprintf("hugetlb limit for %s was set, available page sizes are %v", pagesize, sizes))
+		}
+		if !strings.Contains(err.Error(), "hugetlb") {
+			panic(fmt.Sprintf("hugetlb limit for %s failed with an unclear error: %v", pagesize, err))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+
+	if _, err := stdin.Write([]byte{0}); err != nil {
+		return -1
+	}
+	var res hugetlbResult
+	if err := json.NewDecoder(stdout).Decode(&res); err != nil {
+		stdin.Close()
+		_ = cmd.Wait()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == unix.SIGBUS {
+			panic(fmt.Sprintf("%d huge pages of %s with a limit of %d pages were killed by SIGBUS", pages, pagesize, limitPages))
+		}
+		return 0
+	}
+	overLimit := limitPages >= 0 && pages > limitPages
+	if pages > free || overLimit {
+		if res.MmapErr != unix.ENOMEM.Error() {
+			panic(fmt.Sprintf("mapping %d huge pages of %s, %d free, limit %d: %q", pages, pagesize, free, limitPages, res.MmapErr))
+		}
+	} else if pages > 0 && res.MmapErr != "" {
+		panic(fmt.Sprintf("mapping %d huge pages of %s, %d free, limit %d failed: %s", pages, pagesize, free, limitPages, res.MmapErr))
+	}
+	if res.AnonHugePages > 0 && (thp == "never" || (thp == "madvise" && !madvise)) {
+		panic(fmt.Sprintf("%d bytes of transparent huge pages with %q and madvise %v", res.AnonHugePages, thp, madvise))
+	}
+	return 1
+}
+
+// usernsInitEnv is set to a usernsInit when the fuzzer is re-executed
+// as the container process of FuzzContainerLinuxWithNonRootNS.
+const usernsInitEnv = "_FUZZ_USERNS_INIT"
+
+// usernsInit is what the container process does: list the owners of
+// everything in Rootfs, write a file to it and create Device in it.
+type usernsInit struct {
+	Rootfs string
+	Device devices.Device
+}
+
+// usernsResult is what the container process reports back. Owners
+// maps the names in the rootfs to their uid and gid.
+type usernsResult struct {
+	Owners     map[string][2]int
+	ReadDirErr string
+	WriteErr   string
+	DeviceErr  string
+}
+
+// init runs as root of the user namespace of the container. It lists
+// the rootfs, writes to it like to a writable layer, and creates a
+// device node the same way createDevices does without bind mounts.
+func init() {
+	b := os.Getenv(usernsInitEnv)
+	if b == "" {
+		return
+	}
+	config := &usernsInit{}
+	if err := json.Unmarshal([]byte(b), config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	res := usernsResult{Owners: map[string][2]int{}}
+	names, err := ioutil.ReadDir(config.Rootfs)
+	if err != nil {
+		res.ReadDirErr = err.Error()
+	}
+	for _, fi := range names {
+		st := fi.Sys().(*syscall.Stat_t)
+		res.Owners[fi.Name()] = [2]int{int(st.Uid), int(st.Gid)}
+	}
+	if err := ioutil.WriteFile(filepath.Join(config.Rootfs, "written"), []byte("fuzz"), 0o644); err != nil {
+		res.WriteErr = err.Error()
+	}
+	if err := createDeviceNode(config.Rootfs, &config.Device, false); err != nil {
+		res.DeviceErr = err.Error()
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(&res); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+var (
+	usernsExeOnce sync.Once
+	usernsExe     string
+	usernsExeErr  error
+)
+
+// usernsExecutable returns a copy of the fuzzer that any user can
+// execute. Unless host root is mapped, the container process can not
+// reach a binary in a directory that only root may search.
+func usernsExecutable() (string, error) {
+	usernsExeOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "fuzz-userns-exe")
+		if err != nil {
+			usernsExeErr = err
+			return
+		}
+		if err := os.Chmod(dir, 0o755); err != nil {
+			usernsExeErr = err
+			return
+		}
+		b, err := ioutil.ReadFile("/proc/self/exe")
+		if err != nil {
+			usernsExeErr = err
+			return
+		}
+		usernsExe = filepath.Join(dir, "fuzzer")
+		usernsExeErr = ioutil.WriteFile(usernsExe, b, 0o755)
+	})
+	return usernsExe, usernsExeErr
+}
+
+// readOverflowID returns the id that ids without a mapping are shown
+// as in a user namespace.
+func readOverflowID(name string) int {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/" + name)
+	if err != nil {
+		return 65534
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 65534
+	}
+	return id
+}
+
+// mappedID returns the id that host id shows up as with the mapping m,
+// or overflow if it is not mapped.
+func mappedID(m configs.IDMap, id, overflow int) int {
+	if id < m.HostID || id >= m.HostID+m.Size {
+		return overflow
+	}
+	return id - m.HostID + m.ContainerID
+}
+
+// FuzzContainerLinuxWithNonRootNS fuzzes the uid and gid mappings of
+// a container in a user namespace. The exec fifo is owned by the host
+// uid and gid that container root maps to, and creating it has to
+// fail when root is not mapped. The rootfs is owned by container
+// root, which has to be able to list it. Files in it owned by fuzzed
+// host ids have to show up with the mapped ids, or overflowuid and
+// overflowgid when they are not mapped. A file the container writes
+// is owned by the host ids of container root, and a device node
+// created with container ids is chowned to the corresponding host ids,
+// which has to fail if they are not mapped.
+func FuzzContainerLinuxWithNonRootNS(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var maps struct {
+		UidContainer, UidHost, UidSize uint32
+		GidContainer, GidHost, GidSize uint32
+	}
+	if err := c.GenerateStruct(&maps); err != nil {
+		return -1
+	}
+	if maps.UidSize == 0 || maps.GidSize == 0 {
+		return -1
+	}
+	// Host ids are spread out, so that host uid 1000 can be mapped:
+	uidMap := configs.IDMap{ContainerID: int(maps.UidContainer), HostID: int(maps.UidHost) * 1000, Size: int(maps.UidSize)}
+	gidMap := configs.IDMap{ContainerID: int(maps.GidContainer), HostID: int(maps.GidHost) * 1000, Size: int(maps.GidSize)}
+	hostIDs := func(m configs.IDMap) []int {
+		return []int{0, 1000, 65534, m.HostID - 1, m.HostID, m.HostID + m.Size - 1, m.HostID + m.Size}
+	}
+	containerIDs := func(m configs.IDMap) []int {
+		return []int{0, 65534, m.ContainerID, m.ContainerID + m.Size - 1, m.ContainerID + m.Size}
+	}
+
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	owners := make([][2]int, n%8)
+	for i := range owners {
+		u, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		g, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		uids, gids := hostIDs(uidMap), hostIDs(gidMap)
+		owners[i] = [2]int{uids[u%len(uids)], gids[g%len(gids)]}
+		if owners[i][0] < 0 || owners[i][1] < 0 {
+			return -1
+		}
+	}
+	devUid, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	devGid, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	uids, gids := containerIDs(uidMap), containerIDs(gidMap)
+	node := devices.Device{
+		Rule:     devices.Rule{Type: devices.FifoDevice},
+		Path:     "/dev/fuzz",
+		FileMode: 0o666,
+		Uid:      uint32(uids[devUid%len(uids)]),
+		Gid:      uint32(gids[devGid%len(gids)]),
+	}
+
+	root, err := ioutil.TempDir("", "fuzz-userns")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(root)
+	// Like a bundle, this has to be searchable by the container user:
+	if err := os.Chmod(root, 0o711); err != nil {
+		return -1
+	}
+	rootfs := filepath.Join(root, "rootfs")
+	config := &configs.Config{
+		Rootfs:      rootfs,
+		Namespaces:  configs.Namespaces([]configs.Namespace{{Type: configs.NEWUSER}}),
+		UidMappings: []configs.IDMap{uidMap},
+		GidMappings: []configs.IDMap{gidMap},
+	}
+	rootuid, uerr := config.HostRootUID()
+	rootgid, gerr := config.HostRootGID()
+	if (uerr == nil) != (uidMap.ContainerID == 0) || (gerr == nil) != (gidMap.ContainerID == 0) {
+		panic(fmt.Sprintf("root mapped to %d:%d (%v, %v) with %+v and %+v", rootuid, rootgid, uerr, gerr, uidMap, gidMap))
+	}
+	if uerr == nil && rootuid != uidMap.HostID || gerr == nil && rootgid != gidMap.HostID {
+		panic(fmt.Sprintf("root mapped to %d:%d with %+v and %+v", rootuid, rootgid, uidMap, gidMap))
+	}
+
+	container := &linuxContainer{
+		id:     "fuzz",
+		root:   root,
+		config: config,
+	}
+	err = container.createExecFifo()
+	if uerr != nil || gerr != nil {
+		if err == nil {
+			panic(fmt.Sprintf("exec fifo created without root mapped in %+v and %+v", uidMap, gidMap))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+	fi, err := os.Lstat(filepath.Join(root, execFifoFilename))
+	if err != nil {
+		return -1
+	}
+	if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != rootuid || int(st.Gid) != rootgid {
+		panic(fmt.Sprintf("exec fifo owned by %d:%d instead of %d:%d", st.Uid, st.Gid, rootuid, rootgid))
+	}
+
+	if err := os.Mkdir(rootfs, 0o700); err != nil {
+		return -1
+	}
+	if err := os.Chown(rootfs, rootuid, rootgid); err != nil {
+		return -1
+	}
+	for i, o := range owners {
+		name := filepath.Join(rootfs, "file"+strconv.Itoa(i))
+		if err := ioutil.WriteFile(name, nil, 0o644); err != nil {
+			return -1
+		}
+		if err := os.Chown(name, o[0], o[1]); err != nil {
+			return -1
+		}
+	}
+
+	exe, err := usernsExecutable()
+	if err != nil {
+		return -1
+	}
+	b, err := json.Marshal(&usernsInit{Rootfs: rootfs, Device: node})
+	if err != nil {
+		return -1
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), usernsInitEnv+"="+string(b))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: uidMap.ContainerID, HostID: uidMap.HostID, Size: uidMap.Size}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: gidMap.ContainerID, HostID: gidMap.HostID, Size: gidMap.Size}},
+		Credential:  &syscall.Credential{NoSetGroups: true},
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+	var res usernsResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		panic(fmt.Sprintf("unexpected output %q: %v", out, err))
+	}
+
+	if res.ReadDirErr != "" {
+		panic(fmt.Sprintf("rootfs owned by %d:%d is not accessible to container root: %s", rootuid, rootgid, res.ReadDirErr))
+	}
+	overflowUid, overflowGid := readOverflowID("overflowuid"), readOverflowID("overflowgid")
+	for i, o := range owners {
+		name := "file" + strconv.Itoa(i)
+		expected := [2]int{mappedID(uidMap, o[0], overflowUid), mappedID(gidMap, o[1], overflowGid)}
+		if got, ok := res.Owners[name]; !ok || got != expected {
+			panic(fmt.Sprintf("file owned by %d:%d shown as %v, expected %v with %+v and %+v", o[0], o[1], got, expected, uidMap, gidMap))
+		}
+	}
+
+	if res.WriteErr != "" {
+		panic(fmt.Sprintf("container root can not write to its rootfs: %s", res.WriteErr))
+	}
+	fi, err = os.Lstat(filepath.Join(rootfs, "written"))
+	if err != nil {
+		panic(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != rootuid || int(st.Gid) != rootgid {
+		panic(fmt.Sprintf("file written by container root owned by %d:%d instead of %d:%d", st.Uid, st.Gid, rootuid, rootgid))
+	}
+
+	hostUid, uerr := config.HostUID(int(node.Uid))
+	hostGid, gerr := config.HostGID(int(node.Gid))
+	if uerr != nil || gerr != nil {
+		if res.DeviceErr == "" {
+			panic(fmt.Sprintf("device node chowned to unmapped %d:%d", node.Uid, node.Gid))
+		}
+		return 1
+	}
+	if res.DeviceErr != "" {
+		panic(fmt.Sprintf("device node with mapped owner %d:%d not created: %s", node.Uid, node.Gid, res.DeviceErr))
+	}
+	fi, err = os.Lstat(filepath.Join(rootfs, node.Path))
+	if err != nil {
+		panic(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != hostUid || int(st.Gid) != hostGid {
+		panic(fmt.Sprintf("device node of %d:%d owned by %d:%d instead of %d:%d", node.Uid, node.Gid, st.Uid, st.Gid, hostUid, hostGid))
+	}
+	return 1
+}
@@ -0,0 +1,126 @@
+// +build gofuzz
+
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/sirupsen/logrus"
+)
+
+// logLevels are the level names known to logrus, in mixed case,
+// followed by numeric and padded levels it must not accept.
+var logLevels = []string{
+	"panic",
+	"fatal",
+	"error",
+	"warn",
+	"warning",
+	"info",
+	"debug",
+	"trace",
+	"Info",
+	"DEBUG",
+	"wArNiNg",
+	"4",
+	"-1",
+	"",
+	" info",
+	"info\n",
+}
+
+// FuzzLogLevel parses the log level passed to runc init in
+// _LIBCONTAINER_LOGLEVEL, and forwards an entry logged at that level
+// by runc init to the parent. Entries at the panic and fatal levels
+// are forwarded too, so the logrus panic is recovered and the exit is
+// replaced. runc init refuses to start with a level
+// it cannot parse, as the level returned along with the error is 0
+// (panic), which would disable almost all logging.
+func FuzzLogLevel(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	level := logLevels[i%len(logLevels)]
+	if i >= len(logLevels) {
+		level, err = c.GetString()
+		if err != nil {
+			return -1
+		}
+	}
+	msg, err := c.GetString()
+	if err != nil {
+		msg = "fuzz"
+	}
+
+	lvl, parseErr := logrus.ParseLevel(level)
+	if parseErr == nil {
+		if _, err := strconv.Atoi(level); err == nil {
+			panic(fmt.Sprintf("numeric level %q was parsed as %q", level, lvl))
+		}
+		name := strings.ToLower(level)
+		if name == "warn" {
+			name = "warning"
+		}
+		if lvl > logrus.TraceLevel || lvl.String() != name {
+			panic(fmt.Sprintf("level %q was parsed as %q", level, lvl))
+		}
+	}
+
+	// Forward an entry the way the parent reads them from the log pipe:
+	text, err := json.Marshal(struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{level, msg})
+	if err != nil {
+		return -1
+	}
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(new(logrus.JSONFormatter))
+	logrus.SetLevel(logrus.TraceLevel)
+	// Entries at the fatal and panic levels must not end the fuzzer:
+	logrus.StandardLogger().ExitFunc = func(int) {}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(*logrus.Entry); !ok {
+					panic(r)
+				}
+			}
+		}()
+		processEntry(text)
+	}()
+
+	var out struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		panic(fmt.Sprintf("entry %s was not forwarded: %q", text, buf.String()))
+	}
+	if parseErr != nil {
+		// An unknown level must be reported, not dropped:
+		if out.Level != logrus.ErrorLevel.String() || !strings.Contains(out.Msg, "log level") {
+			panic(fmt.Sprintf("entry %s with an invalid level was forwarded as %+v", text, out))
+		}
+		return 0
+	}
+	var in struct {
+		Msg string `json:"msg"`
+	}
+	if err := json.Unmarshal(text, &in); err != nil {
+		return -1
+	}
+	// processEntry passes the message to Logf as the format:
+	if out.Level != lvl.String() || out.Msg != fmt.Sprintf(in.Msg, []interface{}{}...) {
+		panic(fmt.Sprintf("entry %s was forwarded as %+v", text, out))
+	}
+	return 1
+}
@@ -0,0 +1,446 @@
+// +build gofuzz
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runc/libcontainer/specconv"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+// cwdPrefixes are prepended to the fuzzed cwd to get
+// absolute, relative and traversing paths.
+var cwdPrefixes = []string{"", "/", "./", "../", "/../../", "//"}
+
+// FuzzProcessSpecValidation runs the validation done on the process
+// of the spec before the container is started or a process is
+// executed in it. Traversal in an absolute cwd is allowed: the
+// cwd is created after the container has pivoted into its rootfs.
+func FuzzProcessSpecValidation(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	args := []string{}
+	for i := 0; i < n%8; i++ {
+		arg, err := c.GetString()
+		if err != nil {
+			return -1
+		}
+		args = append(args, arg)
+	}
+	p, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	cwd, err := c.GetString()
+	if err != nil {
+		cwd = ""
+	}
+	cwd = cwdPrefixes[p%len(cwdPrefixes)] + cwd
+
+	err = validateProcessSpec(&specs.Process{
+		Args: args,
+		Cwd:  cwd,
+	})
+	switch {
+	case cwd == "":
+		if err == nil || !strings.Contains(err.Error(), "Cwd") {
+			panic(fmt.Sprintf("empty cwd was not rejected: %v", err))
+		}
+	case !filepath.IsAbs(cwd):
+		if err == nil || !strings.Contains(err.Error(), "Cwd") {
+			panic(fmt.Sprintf("relative cwd %q was not rejected: %v", cwd, err))
+		}
+	case len(args) == 0:
+		if err == nil || !strings.Contains(err.Error(), "args") {
+			panic(fmt.Sprintf("empty args were not rejected: %v", err))
+		}
+	default:
+		if err != nil {
+			panic(fmt.Sprintf("valid process (args %q, cwd %q) was rejected: %v", args, cwd, err))
+		}
+		return 1
+	}
+	return 0
+}
+
+// FuzzProcessRlimits converts the rlimits of the process in the spec.
+// runc does not deduplicate rlimits: they are applied in order with
+// prlimit(2), so the last entry of each type takes effect.
+func FuzzProcessRlimits(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	types := make([]string, 0, len(rlimitMap))
+	for t := range rlimitMap {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	rlimits := []specs.POSIXRlimit{}
+	unknown := false
+	for {
+		t, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		limits := struct {
+			Hard uint64
+			Soft uint64
+		}{}
+		if err := c.GenerateStruct(&limits); err != nil {
+			break
+		}
+		rlimit := specs.POSIXRlimit{Hard: limits.Hard, Soft: limits.Soft}
+		if t < len(types) {
+			rlimit.Type = types[t]
+		} else {
+			// Use an unknown or lowercase type:
+			rlimit.Type, err = c.GetString()
+			if err != nil {
+				break
+			}
+			if _, ok := rlimitMap[rlimit.Type]; !ok {
+				unknown = true
+			}
+		}
+		rlimits = append(rlimits, rlimit)
+	}
+
+	p, err := newProcess(specs.Process{Rlimits: rlimits}, true, "")
+	if unknown {
+		if err == nil {
+			panic(fmt.Sprintf("unknown rlimit types were accepted: %+v", rlimits))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert rlimits %+v: %v", rlimits, err))
+	}
+	if len(p.Rlimits) != len(rlimits) {
+		panic(fmt.Sprintf("expected %d rlimits, got %d", len(rlimits), len(p.Rlimits)))
+	}
+
+	// Apply both lists in order and compare the limits in effect:
+	expected := make(map[int]specs.POSIXRlimit)
+	for _, rlimit := range rlimits {
+		expected[rlimitMap[rlimit.Type]] = rlimit
+	}
+	effective := make(map[int]configs.Rlimit)
+	for _, rlimit := range p.Rlimits {
+		effective[rlimit.Type] = rlimit
+	}
+	if len(effective) != len(expected) {
+		panic(fmt.Sprintf("expected %d rlimit types, got %d", len(expected), len(effective)))
+	}
+	for t, rlimit := range expected {
+		got := effective[t]
+		if got.Hard != rlimit.Hard || got.Soft != rlimit.Soft {
+			panic(fmt.Sprintf("%s: expected %d:%d, got %d:%d", rlimit.Type, rlimit.Soft, rlimit.Hard, got.Soft, got.Hard))
+		}
+	}
+	return 1
+}
+
+// FuzzExecProcessJSON reads the process of runc exec --process from
+// a JSON file and converts it the way exec does. A missing or null
+// user is the zero value, so the process runs as 0:0.
+func FuzzExecProcessJSON(data []byte) int {
+	f, err := ioutil.TempFile("", "fuzz-process")
+	if err != nil {
+		return -1
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return -1
+	}
+	f.Close()
+
+	set := flag.NewFlagSet("exec", flag.ContinueOnError)
+	set.String("process", f.Name(), "")
+	p, err := getProcess(cli.NewContext(cli.NewApp(), set, nil), "")
+	if p == nil {
+		// The JSON could not be decoded:
+		return 0
+	}
+	if len(p.Args) == 0 {
+		if err == nil {
+			panic(fmt.Sprintf("process without args was accepted: %+v", *p))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+
+	lp, err := newProcess(*p, false, "")
+	if err != nil {
+		return 0
+	}
+	if (p.Capabilities == nil) != (lp.Capabilities == nil) {
+		panic(fmt.Sprintf("capabilities %+v were converted to %+v", p.Capabilities, lp.Capabilities))
+	}
+	if user := fmt.Sprintf("%d:%d", p.User.UID, p.User.GID); lp.User != user {
+		panic(fmt.Sprintf("expected user %q, got %q", user, lp.User))
+	}
+	if len(lp.AdditionalGroups) != len(p.User.AdditionalGids) {
+		panic(fmt.Sprintf("expected %d additional gids, got %d", len(p.User.AdditionalGids), len(lp.AdditionalGroups)))
+	}
+	for i, gid := range p.User.AdditionalGids {
+		if lp.AdditionalGroups[i] != strconv.FormatUint(uint64(gid), 10) {
+			panic(fmt.Sprintf("additional gid %d was converted to %q", gid, lp.AdditionalGroups[i]))
+		}
+	}
+	return 1
+}
+
+// memoryLimitNumbers and memoryLimitUnits are combined into the
+// memory limits given to runc update.
+var (
+	memoryLimitNumbers = []string{
+		"0", "1", "512", "1.5", "0.25", ".5", "1.", "1.2.3", "-1", "max", "1e3", "0x10", " 1",
+		"9223372036854775807", "9223372036854775808", "8589934591", "8589934592", "99999999999999999999",
+	}
+	memoryLimitUnits = []string{
+		"", "k", "K", "m", "M", "g", "G", "t", "T", "p", "P", "b", "B", "kb", "KB", "kib", "KiB", "MiB", "mB",
+		"gi", "i", "ib", "e", "EiB", "mm", " m", " ", "m ",
+	}
+)
+
+// memorySize matches the sizes go-units accepts: a number with an
+// optional fraction, followed by an optional unit, "i" and "b".
+var memorySize = regexp.MustCompile(`^(\d+(?:\.\d+)?) ?([kKmMgGtTpP])?[iI]?[bB]?$`)
+
+// memoryLimit is a copy of the inline parse of the memory flags in
+// runc update.
+func memoryLimit(val string) (int64, error) {
+	if val == "-1" {
+		return -1, nil
+	}
+	return units.RAMInBytes(val)
+}
+
+// FuzzMemoryLimitUnits parses the memory limits of runc update. Units
+// are binary and case-insensitive, "b" is optional and a fraction is
+// rounded down. "-1" is unlimited, but "max" is not known and has to
+// be rejected instead of being turned into some limit. A size that
+// does not fit in an int64 must be rejected, not wrap around.
+func FuzzMemoryLimitUnits(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	u, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	val := memoryLimitNumbers[n%len(memoryLimitNumbers)] + memoryLimitUnits[u%len(memoryLimitUnits)]
+	if n >= len(memoryLimitNumbers) {
+		if val, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+
+	limit, err := memoryLimit(val)
+	if val == "-1" {
+		if err != nil || limit != -1 {
+			panic(fmt.Sprintf("-1 was parsed as %d: %v", limit, err))
+		}
+		return 1
+	}
+	m := memorySize.FindStringSubmatch(val)
+	if m == nil {
+		if err == nil {
+			panic(fmt.Sprintf("memory limit %q was parsed as %d", val, limit))
+		}
+		return 0
+	}
+
+	size, ok := new(big.Rat).SetString(m[1])
+	if !ok {
+		return 0
+	}
+	shift := 0
+	if m[2] != "" {
+		shift = strings.Index("kmgtp", strings.ToLower(m[2])) + 1
+	}
+	size.Mul(size, new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), uint(10*shift))))
+	expected := new(big.Int).Quo(size.Num(), size.Denom())
+	if !expected.IsInt64() {
+		if err == nil {
+			panic(fmt.Sprintf("memory limit %q does not fit in an int64, but was parsed as %d", val, limit))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("memory limit %q was rejected: %v", val, err))
+	}
+	if limit < 0 {
+		panic(fmt.Sprintf("memory limit %q wrapped around to %d", val, limit))
+	}
+	// Sizes are parsed as a float64, which has 53 bits of precision:
+	diff := new(big.Int).Sub(expected, big.NewInt(limit))
+	tolerance := new(big.Int).Rsh(expected, 52)
+	if diff.Abs(diff).Cmp(tolerance.Add(tolerance, big.NewInt(1))) > 0 {
+		panic(fmt.Sprintf("memory limit %q was parsed as %d instead of %s", val, limit, expected))
+	}
+	return 1
+}
+
+// specVersions are versions of the runtime spec: older and newer
+// ones than runc supports, pre-releases, build metadata and strings
+// that are not semantic versions at all.
+var specVersions = []string{
+	specs.Version, "1.0.2", "1.0.0", "1.0.0-rc5", "1.0.2-rc.1", "1.0.2+build.1", "1.0.3", "1.1.0", "1.0.10",
+	"2.0.0", "0.6.0", "v1.0.2", "1.0", "1", "", "1.0.2-", "01.0.2", "1.0.2 ", "a.b.c", "1.0.99999999999999999999",
+}
+
+// FuzzSpecVersion loads a config.json with a fuzzed ociVersion and
+// converts it. runc does not look at ociVersion: loadSpec only
+// validates the process, so every version is accepted, and the
+// version of the converted config is always the one runc supports.
+func FuzzSpecVersion(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	v, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	version := specVersions[v%len(specVersions)]
+	if v >= len(specVersions) {
+		if version, err = c.GetString(); err != nil {
+			return -1
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-spec-version")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	b, err := json.Marshal(&specs.Spec{
+		Version: version,
+		Process: &specs.Process{Args: []string{"sh"}, Cwd: "/"},
+		Root:    &specs.Root{Path: "rootfs"},
+		Linux:   &specs.Linux{},
+	})
+	if err != nil {
+		return -1
+	}
+	path := filepath.Join(dir, specConfig)
+	if err := ioutil.WriteFile(path, b, 0o644); err != nil {
+		return -1
+	}
+
+	spec, err := loadSpec(path)
+	var config *configs.Config
+	if err == nil {
+		config, err = specconv.CreateLibcontainerConfig(&specconv.CreateOpts{
+			CgroupName: "fuzz",
+			Spec:       spec,
+		})
+	}
+
+	if err != nil {
+		panic(fmt.Sprintf("spec version %q was rejected: %v", version, err))
+	}
+	if config.Version != specs.Version {
+		panic(fmt.Sprintf("spec version %q was converted to %q", version, config.Version))
+	}
+	return 1
+}
+
+// unixPathMax is the size of sun_path, including the terminating NUL.
+const unixPathMax = len(unix.RawSockaddrUnix{}.Path)
+
+// consoleSocketLengths are offsets from unixPathMax for the length of
+// the console socket path, so that it ends just below, exactly at and
+// just over the limit.
+var consoleSocketLengths = []int{-2, -1, 0, 1, 2, 64}
+
+// FuzzConsoleSocketPath connects to the --console-socket the way runc
+// does for a detached container with a terminal. There is no check of
+// its own: net.Dial rejects paths that do not fit in sun_path with
+// EINVAL, and the error names the path. A NUL byte in the path is not
+// rejected, the kernel stops at it and runc is connected to a socket
+// other than the one it was given.
+func FuzzConsoleSocketPath(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	withNul, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	suffix, err := c.GetString()
+	if err != nil {
+		suffix = ""
+	}
+
+	dir, err := ioutil.TempDir("", "fuzz-console")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(dir)
+	n := unixPathMax + consoleSocketLengths[i%len(consoleSocketLengths)] - len(dir) - 1
+	if n < 1 {
+		return 0
+	}
+	sockpath := filepath.Join(dir, strings.Repeat("s", n))
+	if withNul {
+		sockpath += "\x00" + suffix
+	}
+
+	// Listen on whatever the kernel would connect to if the
+	// path was cut at the first NUL or at the end of sun_path:
+	target := sockpath
+	if j := strings.IndexByte(target, 0); j >= 0 {
+		target = target[:j]
+	}
+	if len(target) >= unixPathMax {
+		target = target[:unixPathMax-1]
+	}
+	l, err := net.Listen("unix", target)
+	if err != nil {
+		return -1
+	}
+	defer l.Close()
+
+	t, err := setupIO(&libcontainer.Process{}, 0, 0, true, true, sockpath)
+	if err != nil {
+		if target == sockpath {
+			panic(fmt.Sprintf("console socket %q was rejected: %v", sockpath, err))
+		}
+		if !errors.Is(err, unix.EINVAL) || !strings.Contains(err.Error(), sockpath) {
+			panic(fmt.Sprintf("console socket %q was rejected with %v", sockpath, err))
+		}
+		return 0
+	}
+	defer t.Close()
+	if target != sockpath {
+		panic(fmt.Sprintf("console socket %q was connected to %q", sockpath, target))
+	}
+	return 1
+}
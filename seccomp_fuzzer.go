@@ -0,0 +1,190 @@
+// +build gofuzz,cgo,seccomp
+
+package seccomp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/opencontainers/runc/libcontainer/configs"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+// syscallNames mixes common syscalls with
+// pseudo-syscalls that do not exist on every arch.
+var syscallNames = []string{
+	"read", "write", "open", "openat", "clone", "clone3",
+	"socketcall", "ipc", "socket", "_llseek", "mmap2", "setuid32",
+}
+
+// exportBPF returns the current BPF program of the filter.
+func exportBPF(filter *libseccomp.ScmpFilter) ([]byte, error) {
+	f, err := ioutil.TempFile("", "fuzz-seccomp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := filter.ExportBPF(f); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+// FuzzSeccompSyscallNames adds ERRNO rules for fuzzed syscall names to
+// an allow-all filter. An empty name is an error. A name libseccomp
+// cannot resolve is taken to be a syscall the kernel does not support:
+// runc skips it without an error and leaves the filter as it was.
+func FuzzSeccompSyscallNames(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	filter, err := libseccomp.NewFilter(actAllow)
+	if err != nil {
+		return -1
+	}
+	defer filter.Release()
+
+	for {
+		t, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		var name string
+		switch t % 3 {
+		case 0:
+			if name, err = c.GetString(); err != nil {
+				return 0
+			}
+		case 1:
+			name = syscallNames[t%len(syscallNames)]
+		case 2:
+			name = strings.ToUpper(syscallNames[t%len(syscallNames)])
+		}
+
+		before, err := exportBPF(filter)
+		if err != nil {
+			return 0
+		}
+		call := &configs.Syscall{
+			Name:   name,
+			Action: configs.Errno,
+		}
+		err = matchCall(filter, call, actAllow)
+		if name == "" {
+			if err == nil {
+				panic("empty syscall name accepted")
+			}
+			continue
+		}
+
+		// Names that can not be resolved are skipped
+		// and must not end up in the filter:
+		if _, lookupErr := libseccomp.GetSyscallFromName(name); lookupErr != nil {
+			if err != nil {
+				panic(fmt.Sprintf("unknown syscall %q was not skipped: %v", name, err))
+			}
+			after, err := exportBPF(filter)
+			if err != nil {
+				return 0
+			}
+			if !bytes.Equal(before, after) {
+				panic(fmt.Sprintf("unknown syscall %q changed the filter", name))
+			}
+		}
+	}
+	return 1
+}
+
+// defaultActions are the OCI seccomp actions and the libseccomp actions
+// they have to result in. ActInvalid marks the actions runc does not
+// support, which have to be rejected.
+var defaultActions = []struct {
+	name   string
+	action libseccomp.ScmpAction
+}{
+	{"SCMP_ACT_KILL", libseccomp.ActKillThread},
+	{"SCMP_ACT_KILL_PROCESS", libseccomp.ActKillProcess},
+	{"SCMP_ACT_TRAP", libseccomp.ActTrap},
+	{"SCMP_ACT_ERRNO", libseccomp.ActErrno},
+	{"SCMP_ACT_TRACE", libseccomp.ActTrace},
+	{"SCMP_ACT_ALLOW", libseccomp.ActAllow},
+	{"SCMP_ACT_LOG", libseccomp.ActLog},
+	{"SCMP_ACT_NOTIFY", libseccomp.ActInvalid},
+	{"scmp_act_allow", libseccomp.ActInvalid},
+}
+
+// FuzzContainerLinuxSeccompDefaultAction converts the default action of
+// a seccomp profile and creates the filter with it. runc has no seccomp
+// notify listener, so SCMP_ACT_NOTIFY is rejected whether or not the
+// kernel supports it. defaultErrnoRet is used by SCMP_ACT_ERRNO and
+// SCMP_ACT_TRACE, which return EPERM without it.
+func FuzzContainerLinuxSeccompDefaultAction(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	i, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	name := defaultActions[i%len(defaultActions)].name
+	expected := defaultActions[i%len(defaultActions)].action
+	if i >= len(defaultActions) {
+		if name, err = c.GetString(); err != nil {
+			return -1
+		}
+		expected = libseccomp.ActInvalid
+	}
+	var errnoRet *uint
+	if set, err := c.GetBool(); err == nil && set {
+		v := struct{ ErrnoRet uint }{}
+		if err := c.GenerateStruct(&v); err != nil {
+			return -1
+		}
+		errnoRet = &v.ErrnoRet
+	}
+
+	act, err := ConvertStringToAction(name)
+	if err != nil {
+		if expected == libseccomp.ActInvalid || expected == libseccomp.ActKillProcess {
+			return 0
+		}
+		panic(fmt.Sprintf("failed to convert default action %q: %v", name, err))
+	}
+	if expected == libseccomp.ActInvalid {
+		panic(fmt.Sprintf("unsupported default action %q was converted to %v", name, act))
+	}
+	defaultAction, err := getAction(act, errnoRet)
+	if err != nil {
+		panic(fmt.Sprintf("failed to get action %v for %q: %v", act, name, err))
+	}
+	filter, err := libseccomp.NewFilter(defaultAction)
+	if err != nil {
+		return 0
+	}
+	defer filter.Release()
+	if _, err := exportBPF(filter); err != nil {
+		panic(fmt.Sprintf("failed to export the filter for %q: %v", name, err))
+	}
+
+	got, err := filter.GetDefaultAction()
+	if err != nil {
+		panic(fmt.Sprintf("failed to get the default action for %q: %v", name, err))
+	}
+	if got&0xFFFF != expected {
+		panic(fmt.Sprintf("default action %q was translated to %v", name, got))
+	}
+	if expected == libseccomp.ActErrno || expected == libseccomp.ActTrace {
+		// The return code is 16 bits wide and must not be truncated:
+		ret := uint(unix.EPERM)
+		if errnoRet != nil {
+			ret = *errnoRet
+		}
+		if uint(uint16(got.GetReturnCode())) != ret {
+			panic(fmt.Sprintf("default action %q with errno %d returns %d", name, ret, uint16(got.GetReturnCode())))
+		}
+	}
+	return 1
+}
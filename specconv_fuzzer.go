@@ -3,13 +3,23 @@
 package specconv
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/opencontainers/runc/libcontainer/cgroups/systemd"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	"github.com/opencontainers/runc/libcontainer/configs/validate"
+	"github.com/opencontainers/runc/libcontainer/devices"
+	libcontainerUtils "github.com/opencontainers/runc/libcontainer/utils"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 
 	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
 )
@@ -90,4 +100,1303 @@ func Fuzz(data []byte) int {
 	err = um.Apply(int(data[0]))
 	err = um.Destroy()
 	return 1
-}
\ No newline at end of file
+}
+
+func FuzzSpecAnnotations(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+
+	// Create the annotations. We keep adding
+	// entries until the fuzz data runs out:
+	annotations := make(map[string]string)
+	for {
+		k, err := c.GetString()
+		if err != nil {
+			break
+		}
+		v, err := c.GetString()
+		if err != nil {
+			break
+		}
+		annotations[k] = v
+	}
+
+	spec := &specs.Spec{
+		Root:        &specs.Root{Path: "rootfs"},
+		Linux:       &specs.Linux{},
+		Annotations: annotations,
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+
+	rcwd, err := os.Getwd()
+	if err != nil {
+		return 0
+	}
+	cwd, err := filepath.Abs(rcwd)
+	if err != nil {
+		return 0
+	}
+
+	// The labels must be key=value entries with
+	// the bundle label appended last:
+	if len(config.Labels) != len(annotations)+1 {
+		panic(fmt.Sprintf("expected %d labels, got %d", len(annotations)+1, len(config.Labels)))
+	}
+	for _, l := range config.Labels {
+		if !strings.Contains(l, "=") {
+			panic(fmt.Sprintf("malformed label %q", l))
+		}
+	}
+	if config.Labels[len(config.Labels)-1] != "bundle="+cwd {
+		panic(fmt.Sprintf("bundle label missing, got %q", config.Labels[len(config.Labels)-1]))
+	}
+
+	// No annotation may overwrite the bundle, and every
+	// annotation that can be represented must round-trip.
+	// Keys containing "=" shadow the key before the "=".
+	bundle, userAnnotations := libcontainerUtils.Annotations(config.Labels)
+	if bundle != cwd {
+		panic(fmt.Sprintf("bundle overwritten: %q != %q", bundle, cwd))
+	}
+	shadowed := make(map[string]bool)
+	for k := range annotations {
+		if i := strings.IndexByte(k, '='); i >= 0 {
+			shadowed[k[:i]] = true
+		}
+	}
+	for k, v := range annotations {
+		if k == "bundle" || shadowed[k] || strings.Contains(k, "=") {
+			continue
+		}
+		if got, ok := userAnnotations[k]; !ok || got != v {
+			panic(fmt.Sprintf("annotation %q=%q did not round-trip, got %q", k, v, got))
+		}
+	}
+	return 1
+}
+
+// FuzzMountOrdering checks that mounts keep the order given in the spec.
+// runc does not sort mounts; the spec author is responsible for
+// listing parent mounts before the mounts nested below them.
+func FuzzMountOrdering(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	mounts := []specs.Mount{}
+	for {
+		t, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		name, err := c.GetString()
+		if err != nil {
+			break
+		}
+		dest := "/" + name
+		if len(mounts) > 0 {
+			// Nest below, duplicate or add a trailing
+			// slash to one of the previous mounts:
+			prev := mounts[t%len(mounts)].Destination
+			switch t % 4 {
+			case 0:
+				dest = filepath.Join(prev, name)
+			case 1:
+				dest = prev
+			case 2:
+				dest = prev + "/"
+			}
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: dest,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+		})
+	}
+
+	spec := &specs.Spec{
+		Root:   &specs.Root{Path: "rootfs"},
+		Linux:  &specs.Linux{},
+		Mounts: mounts,
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+	if len(config.Mounts) != len(mounts) {
+		panic(fmt.Sprintf("expected %d mounts, got %d", len(mounts), len(config.Mounts)))
+	}
+	for i, m := range config.Mounts {
+		if m.Destination != mounts[i].Destination {
+			panic(fmt.Sprintf("mount %d: expected %q, got %q", i, mounts[i].Destination, m.Destination))
+		}
+	}
+	return 1
+}
+
+// annotationKeyPrefixes contains the one annotation prefix that runc
+// interprets, followed by a number of near misses which must be
+// treated as plain labels.
+var annotationKeyPrefixes = []string{
+	"org.systemd.property.",
+	"org.systemd.property",
+	"org.systemd.properties.",
+	"org.systemd.Property.",
+	"Org.systemd.property.",
+	"org.systemd.property..",
+	" org.systemd.property.",
+	"org.systemd.property.org.systemd.property.",
+	"",
+}
+
+// annotationValues are dbus values that look alike but have different
+// types, such as the boolean true and the string "true".
+var annotationValues = []string{
+	"true",
+	`"true"`,
+	"1",
+	"uint64 1",
+	"@t 1",
+	"-1",
+	"18446744073709551615",
+	"1.5",
+}
+
+func FuzzContainerSpecAnnotationsToConfig(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	annotations := make(map[string]string)
+	for {
+		p, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		name, err := c.GetString()
+		if err != nil {
+			break
+		}
+		v, err := c.GetString()
+		if err != nil {
+			break
+		}
+		// Either use a fuzzed value, one of the values above
+		// or a very large value:
+		useKnown, err := c.GetBool()
+		if err != nil {
+			break
+		}
+		repeat, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		if useKnown {
+			v = annotationValues[repeat%len(annotationValues)]
+		} else if repeat > 200 {
+			v = strings.Repeat(v, repeat*64)
+		}
+		annotations[annotationKeyPrefixes[p%len(annotationKeyPrefixes)]+name] = v
+	}
+
+	const keyPrefix = "org.systemd.property."
+	interpreted := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, keyPrefix) {
+			interpreted[strings.TrimPrefix(k, keyPrefix)] = v
+		}
+	}
+
+	spec := &specs.Spec{
+		Root:        &specs.Root{Path: "rootfs"},
+		Linux:       &specs.Linux{},
+		Annotations: annotations,
+	}
+	opts := &CreateOpts{
+		CgroupName:       "fuzz",
+		UseSystemdCgroup: true,
+		Spec:             spec,
+	}
+	cg, err := CreateCgroupConfig(opts, nil)
+	if err != nil {
+		// Only the systemd property annotations can fail:
+		if len(interpreted) == 0 {
+			panic(fmt.Sprintf("annotations without %q prefix were rejected: %v", keyPrefix, err))
+		}
+		return 0
+	}
+
+	// Every property must come from an annotation with the exact
+	// prefix and a valid name; near misses must be ignored.
+	if len(cg.SystemdProps) != len(interpreted) {
+		panic(fmt.Sprintf("expected %d systemd properties, got %d", len(interpreted), len(cg.SystemdProps)))
+	}
+	for _, prop := range cg.SystemdProps {
+		if !isValidName(prop.Name) {
+			panic(fmt.Sprintf("invalid systemd property name %q", prop.Name))
+		}
+		// The value must be passed on with the type the
+		// annotation value parses to, except for names ending
+		// in "Sec", which are converted to "USec" in uint64:
+		matched := false
+		if v, ok := interpreted[prop.Name]; ok {
+			value, err := dbus.ParseVariant(v, dbus.Signature{})
+			matched = err == nil && value.Signature() == prop.Value.Signature()
+		}
+		orig := strings.TrimSuffix(prop.Name, "USec") + "Sec"
+		if _, ok := interpreted[orig]; ok && isSecSuffix(orig) {
+			matched = matched || prop.Value.Signature().String() == "t"
+		}
+		if !matched {
+			panic(fmt.Sprintf("systemd property %q=%s does not match any annotation", prop.Name, prop.Value))
+		}
+	}
+
+	// Annotations must not change anything else in the config:
+	config, err := CreateLibcontainerConfig(opts)
+	if err != nil {
+		return 0
+	}
+	spec.Annotations = nil
+	refConfig, err := CreateLibcontainerConfig(opts)
+	if err != nil {
+		panic(fmt.Sprintf("config without annotations failed: %v", err))
+	}
+	config.Labels, refConfig.Labels = nil, nil
+	config.Cgroups.SystemdProps, refConfig.Cgroups.SystemdProps = nil, nil
+	if !reflect.DeepEqual(config, refConfig) {
+		panic("annotations changed the container config")
+	}
+	return 1
+}
+
+// bindMountOptions are the options that affect how a
+// recursive bind mount and its submounts are set up.
+var bindMountOptions = []string{"rbind", "bind", "ro", "rw", "nosuid", "suid", "remount", "defaults", "rprivate", "private", "rslave"}
+
+// FuzzRecursiveBindMountFlags computes the flags of a bind mount from
+// its options. The bind mount is remounted with the same flags, and as
+// the kernel ignores MS_REC on a remount, a read-only recursive bind
+// mount is only read-only at the top; submounts are not re-applied.
+func FuzzRecursiveBindMountFlags(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	options := []string{}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		if i < len(bindMountOptions) {
+			options = append(options, bindMountOptions[i])
+			continue
+		}
+		o, err := c.GetString()
+		if err != nil {
+			break
+		}
+		options = append(options, o)
+	}
+
+	// "bind" does not clear the MS_REC set by "rbind",
+	// and the last one of "ro" and "rw" wins.
+	var bind, recursive, readonly bool
+	for _, o := range options {
+		switch o {
+		case "bind":
+			bind = true
+		case "rbind":
+			bind, recursive = true, true
+		case "ro":
+			readonly = true
+		case "rw":
+			readonly = false
+		}
+	}
+
+	m, err := createLibcontainerMount("/", specs.Mount{
+		Destination: "/mnt",
+		Type:        "none",
+		Source:      "/src",
+		Options:     options,
+	})
+	if err != nil {
+		return 0
+	}
+	if (m.Flags&unix.MS_BIND != 0) != bind || (m.Device == "bind") != bind {
+		panic(fmt.Sprintf("options %q: bind is %t, but got flags %#x and type %q", options, bind, m.Flags, m.Device))
+	}
+	if (m.Flags&unix.MS_REC != 0) != recursive {
+		panic(fmt.Sprintf("options %q: recursive is %t, but got flags %#x", options, recursive, m.Flags))
+	}
+	if (m.Flags&unix.MS_RDONLY != 0) != readonly {
+		panic(fmt.Sprintf("options %q: readonly is %t, but got flags %#x", options, readonly, m.Flags))
+	}
+	if !bind {
+		return 0
+	}
+
+	// A bind mount is only remounted if it has flags other than
+	// these, which is how the read-only flag gets applied:
+	if readonly && m.Flags&^(unix.MS_REC|unix.MS_REMOUNT|unix.MS_BIND) == 0 {
+		panic(fmt.Sprintf("options %q: read-only bind mount is not remounted", options))
+	}
+	return 1
+}
+
+// mountFlagPairs are options that set a mount flag, each
+// with the option that clears it again.
+var mountFlagPairs = []struct {
+	set, clear string
+	flag       int
+}{
+	{"ro", "rw", unix.MS_RDONLY},
+	{"nodev", "dev", unix.MS_NODEV},
+	{"nosuid", "suid", unix.MS_NOSUID},
+	{"noexec", "exec", unix.MS_NOEXEC},
+	{"noatime", "atime", unix.MS_NOATIME},
+	{"sync", "async", unix.MS_SYNCHRONOUS},
+}
+
+// FuzzMountFlagClearing converts mount options that set and clear the
+// same flags, in any order and any number of times. For each pair the
+// last option given must win.
+func FuzzMountFlagClearing(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	options := []string{}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		if i >= 2*len(mountFlagPairs) {
+			// Add a filesystem specific option:
+			o, err := c.GetString()
+			if err != nil {
+				break
+			}
+			options = append(options, o)
+			continue
+		}
+		p := mountFlagPairs[i/2]
+		if i%2 == 0 {
+			options = append(options, p.set)
+		} else {
+			options = append(options, p.clear)
+		}
+	}
+
+	expected := make(map[int]bool)
+	for _, o := range options {
+		for _, p := range mountFlagPairs {
+			switch o {
+			case p.set:
+				expected[p.flag] = true
+			case p.clear:
+				expected[p.flag] = false
+			}
+		}
+	}
+
+	m, err := createLibcontainerMount("/", specs.Mount{
+		Destination: "/mnt",
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     options,
+	})
+	if err != nil {
+		return 0
+	}
+	for _, p := range mountFlagPairs {
+		if (m.Flags&p.flag != 0) != expected[p.flag] {
+			panic(fmt.Sprintf("options %q: %s is %t, but got flags %#x", options, p.set, expected[p.flag], m.Flags))
+		}
+	}
+	// Neither option of a pair is passed on as data:
+	for _, d := range strings.Split(m.Data, ",") {
+		for _, p := range mountFlagPairs {
+			if d == p.set || d == p.clear {
+				panic(fmt.Sprintf("options %q: %q passed as data %q", options, d, m.Data))
+			}
+		}
+	}
+	return 1
+}
+
+// sysfsMaskedPaths are paths below /sys that a container
+// config may mask or make read-only.
+var sysfsMaskedPaths = []string{
+	"/sys/kernel/debug",
+	"/sys/firmware",
+	"/sys/fs/cgroup",
+	"/sys/fs/cgroup/memory",
+	"/sys/fs",
+	"/sys",
+	"/sys/fs/cgroup/../cgroup",
+}
+
+// FuzzContainerLinuxSysfsMount sets up /sys as a read-write or
+// read-only sysfs, or leaves it out, together with a cgroup mount
+// and masked or read-only paths below /sys. The cgroup mount is
+// only read-only if its own options say so. The masked and read-only
+// paths are passed through as they are, even when they cover the
+// cgroup mount.
+func FuzzContainerLinuxSysfsMount(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	sysMode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	cgroupMode, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	var masked, readonly []string
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		p := sysfsMaskedPaths[i%len(sysfsMaskedPaths)]
+		if (i/len(sysfsMaskedPaths))%2 == 0 {
+			masked = append(masked, p)
+		} else {
+			readonly = append(readonly, p)
+		}
+	}
+
+	mounts := []specs.Mount{}
+	switch sysMode % 3 {
+	case 1:
+		mounts = append(mounts, specs.Mount{
+			Destination: "/sys",
+			Type:        "sysfs",
+			Source:      "sysfs",
+			Options:     []string{"nosuid", "noexec", "nodev"},
+		})
+	case 2:
+		mounts = append(mounts, specs.Mount{
+			Destination: "/sys",
+			Type:        "sysfs",
+			Source:      "sysfs",
+			Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+		})
+	}
+	cgroupRW := false
+	switch cgroupMode % 3 {
+	case 1:
+		cgroupRW = true
+		mounts = append(mounts, specs.Mount{
+			Destination: "/sys/fs/cgroup",
+			Type:        "cgroup",
+			Source:      "cgroup",
+			Options:     []string{"nosuid", "noexec", "nodev", "relatime", "rw"},
+		})
+	case 2:
+		mounts = append(mounts, specs.Mount{
+			Destination: "/sys/fs/cgroup",
+			Type:        "cgroup",
+			Source:      "cgroup",
+			Options:     []string{"nosuid", "noexec", "nodev", "relatime", "ro"},
+		})
+	}
+
+	rootfs, err := newTestRoot("fuzz-sysfs")
+	if err != nil {
+		return -1
+	}
+	defer os.RemoveAll(rootfs)
+	spec := &specs.Spec{
+		Root:   &specs.Root{Path: rootfs},
+		Mounts: mounts,
+		Linux: &specs.Linux{
+			Namespaces:    []specs.LinuxNamespace{{Type: specs.MountNamespace}},
+			MaskedPaths:   masked,
+			ReadonlyPaths: readonly,
+		},
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+	if err := validate.New().Validate(config); err != nil {
+		return 0
+	}
+
+	var sys, cgroup *configs.Mount
+	for i, m := range config.Mounts {
+		switch m.Destination {
+		case "/sys":
+			sys = m
+		case "/sys/fs/cgroup":
+			if sys == nil && sysMode%3 != 0 {
+				panic(fmt.Sprintf("cgroup mount %d is mounted before /sys", i))
+			}
+			cgroup = m
+		}
+	}
+	if (sys != nil) != (sysMode%3 != 0) || (cgroup != nil) != (cgroupMode%3 != 0) {
+		panic(fmt.Sprintf("expected sysfs and cgroup mounts %q, got %+v", mounts, config.Mounts))
+	}
+	if sys != nil && (sys.Flags&unix.MS_RDONLY != 0) != (sysMode%3 == 2) {
+		panic(fmt.Sprintf("/sys mounted with flags %#x", sys.Flags))
+	}
+	if cgroup == nil {
+		return 0
+	}
+	if (cgroup.Flags&unix.MS_RDONLY == 0) != cgroupRW {
+		panic(fmt.Sprintf("cgroup mount is read-write: %t, but got flags %#x", cgroupRW, cgroup.Flags))
+	}
+
+	// The restrictions on /sys are kept in order, unchanged:
+	if len(config.MaskPaths) != len(masked) || (len(masked) > 0 && !reflect.DeepEqual(config.MaskPaths, masked)) {
+		panic(fmt.Sprintf("masked paths %q became %q", masked, config.MaskPaths))
+	}
+	if len(config.ReadonlyPaths) != len(readonly) || (len(readonly) > 0 && !reflect.DeepEqual(config.ReadonlyPaths, readonly)) {
+		panic(fmt.Sprintf("read-only paths %q became %q", readonly, config.ReadonlyPaths))
+	}
+	return 1
+}
+
+// FuzzDeviceDefaultsMerge merges AllowedDevices into a spec with some
+// of the default device nodes and with device rules that allow or deny
+// the default devices. The default rules are appended after the rules
+// of the spec, except for the device nodes the spec already has, so
+// they take precedence over a deny in the spec, by design: the
+// wildcard mknod rules and the default devices are always allowed.
+func FuzzDeviceDefaultsMerge(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	nodes := []specs.LinuxDevice{}
+	for _, ad := range AllowedDevices {
+		if ad.Path == "" {
+			continue
+		}
+		include, err := c.GetBool()
+		if err != nil {
+			return -1
+		}
+		if include {
+			nodes = append(nodes, specs.LinuxDevice{
+				Path:  ad.Path,
+				Type:  "c",
+				Major: ad.Major,
+				Minor: ad.Minor,
+			})
+		}
+	}
+	rules := []specs.LinuxDeviceCgroup{}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		allow, err := c.GetBool()
+		if err != nil {
+			break
+		}
+		if i >= len(AllowedDevices) {
+			// Deny or allow all devices:
+			rules = append(rules, specs.LinuxDeviceCgroup{Allow: allow, Access: "rwm"})
+			continue
+		}
+		ad := AllowedDevices[i]
+		major, minor := ad.Major, ad.Minor
+		rule := specs.LinuxDeviceCgroup{
+			Allow:  allow,
+			Type:   string(ad.Type),
+			Access: string(ad.Permissions),
+		}
+		if major != devices.Wildcard {
+			rule.Major = &major
+		}
+		if minor != devices.Wildcard {
+			rule.Minor = &minor
+		}
+		rules = append(rules, rule)
+	}
+
+	spec := &specs.Spec{
+		Root: &specs.Root{Path: "rootfs"},
+		Linux: &specs.Linux{
+			Devices:   nodes,
+			Resources: &specs.LinuxResources{Devices: rules},
+		},
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+
+	// Every default device node is created exactly once:
+	for _, ad := range AllowedDevices {
+		if ad.Path == "" {
+			continue
+		}
+		n := 0
+		for _, d := range config.Devices {
+			if d.Path == ad.Path {
+				n++
+			}
+		}
+		if n != 1 {
+			panic(fmt.Sprintf("device %q is created %d times", ad.Path, n))
+		}
+	}
+
+	// The default rules follow the rules of the spec, without
+	// the ones of the device nodes given in the spec:
+	defaultRules := config.Cgroups.Resources.Devices[len(rules):]
+	expected := 0
+next:
+	for _, ad := range AllowedDevices {
+		for _, n := range nodes {
+			if ad.Path != "" && n.Path == ad.Path {
+				continue next
+			}
+		}
+		if expected >= len(defaultRules) || *defaultRules[expected] != ad.Rule {
+			panic(fmt.Sprintf("default rule %+v is missing: %+v", ad.Rule, defaultRules))
+		}
+		expected++
+	}
+	if expected != len(defaultRules) {
+		panic(fmt.Sprintf("expected %d default rules, got %d", expected, len(defaultRules)))
+	}
+
+	return 1
+}
+
+// FuzzSpecCapabilitiesNil converts the example spec, made rootless or
+// not, with capabilities that are missing or have missing sets. A
+// missing capabilities object is left nil in the config, and the init
+// process then uses empty capability sets.
+func FuzzSpecCapabilitiesNil(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	rootless, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	withCaps, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	spec := Example()
+	if rootless {
+		ToRootless(spec)
+	}
+	spec.Process.Capabilities = nil
+	if withCaps {
+		caps := &specs.LinuxCapabilities{}
+		for _, set := range []*[]string{&caps.Bounding, &caps.Effective, &caps.Inheritable, &caps.Permitted, &caps.Ambient} {
+			n, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			if n%3 == 0 {
+				// Leave the set nil:
+				continue
+			}
+			*set = []string{}
+			for i := 0; i < n%3-1; i++ {
+				name, err := c.GetString()
+				if err != nil {
+					break
+				}
+				*set = append(*set, name)
+			}
+		}
+		spec.Process.Capabilities = caps
+	}
+
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName:      "fuzz",
+		Spec:            spec,
+		RootlessEUID:    rootless,
+		RootlessCgroups: rootless,
+	})
+	if err != nil {
+		return 0
+	}
+	if !withCaps {
+		if config.Capabilities != nil {
+			panic(fmt.Sprintf("missing capabilities converted to %+v", *config.Capabilities))
+		}
+		return 1
+	}
+	if config.Capabilities == nil {
+		panic(fmt.Sprintf("capabilities %+v were dropped", *spec.Process.Capabilities))
+	}
+	caps := spec.Process.Capabilities
+	got := config.Capabilities
+	if !reflect.DeepEqual(caps.Bounding, got.Bounding) || !reflect.DeepEqual(caps.Effective, got.Effective) ||
+		!reflect.DeepEqual(caps.Inheritable, got.Inheritable) || !reflect.DeepEqual(caps.Permitted, got.Permitted) ||
+		!reflect.DeepEqual(caps.Ambient, got.Ambient) {
+		panic(fmt.Sprintf("capabilities %+v converted to %+v", *caps, *got))
+	}
+	return 1
+}
+
+// utsNames are host and domain names around the kernel's limit of
+// __NEW_UTS_LEN (64) bytes, and names sethostname(2) may not take.
+var utsNames = []string{
+	"", "fuzz", "host.example.com", "a b", "a\x00b", "\x00",
+	strings.Repeat("a", 64), strings.Repeat("a", 65), strings.Repeat("a", 63) + "\x00",
+}
+
+// FuzzSpecUTSNames converts and validates the host and domain names of
+// a spec. This version of runc ignores the domainname of the spec, so
+// the domain name is set with the kernel.domainname sysctl instead.
+// Both are converted as they are, and the validator only requires a
+// UTS namespace for them; names the kernel rejects, such as ones
+// longer than 64 bytes, only fail once the container starts.
+func FuzzSpecUTSNames(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var names [2]string
+	for i := range names {
+		n, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		names[i] = utsNames[n%len(utsNames)]
+		if n >= len(utsNames) {
+			if names[i], err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+	}
+	hostname, domainname := names[0], names[1]
+	utsns, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+
+	spec := &specs.Spec{
+		Root:     &specs.Root{Path: "rootfs"},
+		Hostname: hostname,
+		Linux:    &specs.Linux{},
+	}
+	if utsns {
+		spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.UTSNamespace}}
+	}
+	if domainname != "" {
+		spec.Linux.Sysctl = map[string]string{"kernel.domainname": domainname}
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+	if config.Hostname != hostname || config.Sysctl["kernel.domainname"] != domainname {
+		panic(fmt.Sprintf("names %q and %q were converted to %q and %q", hostname, domainname, config.Hostname, config.Sysctl["kernel.domainname"]))
+	}
+	config.Rootfs = "/"
+
+	err = validate.New().Validate(config)
+	if !utsns && (hostname != "" || domainname != "") {
+		if err == nil {
+			panic(fmt.Sprintf("names %q and %q were accepted without a UTS namespace", hostname, domainname))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("names %q and %q were rejected: %v", hostname, domainname, err))
+	}
+	return 1
+}
+
+// seccompFlags are flags of the seccomp filter in the spec, including
+// flags that are mutually exclusive and names runc has never known.
+var seccompFlags = []specs.LinuxSeccompFlag{
+	specs.LinuxSeccompFlagLog, specs.LinuxSeccompFlagSpecAllow, specs.LinuxSeccompFlagWaitKillableRecv,
+	"SECCOMP_FILTER_FLAG_NEW_LISTENER", "SECCOMP_FILTER_FLAG_TSYNC", "SECCOMP_FILTER_FLAG_TSYNC_ESRCH",
+	"seccomp_filter_flag_log", "",
+}
+
+// FuzzSpecSeccompFlags converts a seccomp filter with a list of flags.
+// This version of runc has no flags in its seccomp config, so there is
+// no mask to build: any flag, known or not, must be rejected rather
+// than dropped. A filter without a default action and syscalls means
+// seccomp is disabled, and then the flags are ignored with it.
+func FuzzSpecSeccompFlags(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	enabled, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	spec := &specs.LinuxSeccomp{}
+	if enabled {
+		spec.DefaultAction = specs.ActErrno
+		spec.Syscalls = []specs.LinuxSyscall{{Names: []string{"mount"}, Action: specs.ActAllow}}
+	}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		flag := seccompFlags[i%len(seccompFlags)]
+		if i >= len(seccompFlags) {
+			s, err := c.GetString()
+			if err != nil {
+				break
+			}
+			flag = specs.LinuxSeccompFlag(s)
+		}
+		spec.Flags = append(spec.Flags, flag)
+	}
+
+	config, err := SetupSeccomp(spec)
+	if !enabled {
+		if config != nil || err != nil {
+			panic(fmt.Sprintf("disabled seccomp with flags %q was converted to %+v: %v", spec.Flags, config, err))
+		}
+		return 0
+	}
+	if len(spec.Flags) != 0 {
+		if err == nil || !strings.Contains(err.Error(), "flags") {
+			panic(fmt.Sprintf("seccomp flags %q were not rejected: %v", spec.Flags, err))
+		}
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("seccomp without flags was rejected: %v", err))
+	}
+	if len(config.Syscalls) != 1 || config.Syscalls[0].Name != "mount" {
+		panic(fmt.Sprintf("seccomp was converted to %+v", config))
+	}
+	return 1
+}
+
+// netPrioInterfaces are interface names of net_prio priorities,
+// including names the kernel would never give an interface.
+var netPrioInterfaces = []string{"eth0", "lo", "veth1234567890a", "veth1234567890ab", "eth0 1", "eth0\nlo 2", "../eth0", ""}
+
+// FuzzSpecNetworkTrafficClass converts the network resources of the
+// spec. runc has no bandwidth limits: there is no rate, ceil or burst
+// in the spec or the config, and runc never runs tc. The parameters it
+// has for traffic control are the net_cls classid that tc filters can
+// match on, as major:minor in the upper and lower 16 bits, and the
+// net_prio priorities. A classid of 0 is the same as none. Both are
+// passed through as they are: the interface names and priorities are
+// not validated, that is left to the kernel when they are written.
+func FuzzSpecNetworkTrafficClass(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	network := &specs.LinuxNetwork{}
+	hasClassID, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	if hasClassID {
+		var classID struct{ V uint32 }
+		if err := c.GenerateStruct(&classID); err != nil {
+			return -1
+		}
+		network.ClassID = &classID.V
+	}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		var prio struct{ V uint32 }
+		if err := c.GenerateStruct(&prio); err != nil {
+			break
+		}
+		name := netPrioInterfaces[i%len(netPrioInterfaces)]
+		if i >= len(netPrioInterfaces) {
+			if name, err = c.GetString(); err != nil {
+				break
+			}
+		}
+		network.Priorities = append(network.Priorities, specs.LinuxInterfacePriority{Name: name, Priority: prio.V})
+	}
+
+	spec := &specs.Spec{
+		Root: &specs.Root{Path: "rootfs"},
+		Linux: &specs.Linux{
+			Resources: &specs.LinuxResources{Network: network},
+		},
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err == nil {
+		config.Rootfs = "/"
+		err = validate.New().Validate(config)
+	}
+	if err != nil {
+		return 0
+	}
+
+	r := config.Cgroups.Resources
+	if network.ClassID != nil && r.NetClsClassid != *network.ClassID {
+		panic(fmt.Sprintf("classid %#x (%d:%d) became %#x", *network.ClassID, *network.ClassID>>16, *network.ClassID&0xffff, r.NetClsClassid))
+	}
+	if network.ClassID == nil && r.NetClsClassid != 0 {
+		panic(fmt.Sprintf("classid %#x was set without one in the spec", r.NetClsClassid))
+	}
+	if len(r.NetPrioIfpriomap) != len(network.Priorities) {
+		panic(fmt.Sprintf("%d priorities became %d", len(network.Priorities), len(r.NetPrioIfpriomap)))
+	}
+	for i, p := range network.Priorities {
+		m := r.NetPrioIfpriomap[i]
+		if m.Interface != p.Name || m.Priority != int64(p.Priority) {
+			panic(fmt.Sprintf("priority %+v became %+v", p, *m))
+		}
+	}
+	return 1
+}
+
+// mountOptionFlags are the options of the runtime spec that runc
+// turns into mount flags, with whether they set or clear the flag.
+// Any other option is passed on to the filesystem as data.
+var mountOptionFlags = map[string]struct {
+	clear bool
+	flag  int
+}{
+	"acl":           {false, unix.MS_POSIXACL},
+	"async":         {true, unix.MS_SYNCHRONOUS},
+	"atime":         {true, unix.MS_NOATIME},
+	"bind":          {false, unix.MS_BIND},
+	"dev":           {true, unix.MS_NODEV},
+	"diratime":      {true, unix.MS_NODIRATIME},
+	"dirsync":       {false, unix.MS_DIRSYNC},
+	"exec":          {true, unix.MS_NOEXEC},
+	"iversion":      {false, unix.MS_I_VERSION},
+	"lazytime":      {false, unix.MS_LAZYTIME},
+	"loud":          {true, unix.MS_SILENT},
+	"mand":          {false, unix.MS_MANDLOCK},
+	"noacl":         {true, unix.MS_POSIXACL},
+	"noatime":       {false, unix.MS_NOATIME},
+	"nodev":         {false, unix.MS_NODEV},
+	"nodiratime":    {false, unix.MS_NODIRATIME},
+	"noexec":        {false, unix.MS_NOEXEC},
+	"noiversion":    {true, unix.MS_I_VERSION},
+	"nolazytime":    {true, unix.MS_LAZYTIME},
+	"nomand":        {true, unix.MS_MANDLOCK},
+	"norelatime":    {true, unix.MS_RELATIME},
+	"nostrictatime": {true, unix.MS_STRICTATIME},
+	"nosuid":        {false, unix.MS_NOSUID},
+	"rbind":         {false, unix.MS_BIND | unix.MS_REC},
+	"relatime":      {false, unix.MS_RELATIME},
+	"remount":       {false, unix.MS_REMOUNT},
+	"ro":            {false, unix.MS_RDONLY},
+	"rw":            {true, unix.MS_RDONLY},
+	"silent":        {false, unix.MS_SILENT},
+	"strictatime":   {false, unix.MS_STRICTATIME},
+	"suid":          {true, unix.MS_NOSUID},
+	"sync":          {false, unix.MS_SYNCHRONOUS},
+}
+
+// mountPropagationFlags are the propagation options of the runtime spec.
+var mountPropagationFlags = map[string]int{
+	"private":     unix.MS_PRIVATE,
+	"shared":      unix.MS_SHARED,
+	"slave":       unix.MS_SLAVE,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// mountDataOptions are options that runc does not know
+// and has to pass on to the filesystem unchanged.
+var mountDataOptions = []string{
+	"mode=755", "size=65536k", "uid=0", "gid=5", "newinstance", "ptmxmode=0666",
+	"x-systemd.automount", "defaults", "NODEV", "ro ", "mode=755,size=1k",
+}
+
+// FuzzSpecMountConversion converts the mounts of a spec, with any
+// number of known, repeated and unknown options. The options that runc
+// knows become flags, where the last of two opposite options wins, and
+// propagation flags, which are kept in order. "tmpcopyup" sets the
+// copy-up extension. Everything else, including "defaults", has to end
+// up in the data in the order given. As the data is joined with commas,
+// only the joined string can be compared.
+func FuzzSpecMountConversion(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	known := make([]string, 0, len(mountOptionFlags)+len(mountPropagationFlags))
+	for o := range mountOptionFlags {
+		known = append(known, o)
+	}
+	for o := range mountPropagationFlags {
+		known = append(known, o)
+	}
+	sort.Strings(known)
+	known = append(known, "tmpcopyup")
+	known = append(known, mountDataOptions...)
+
+	mounts := []specs.Mount{}
+	for {
+		n, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		dest, err := c.GetString()
+		if err != nil {
+			break
+		}
+		source, err := c.GetString()
+		if err != nil {
+			break
+		}
+		options := []string{}
+		for i := 0; i < n%8; i++ {
+			j, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			o := known[j%len(known)]
+			if j >= len(known) {
+				if o, err = c.GetString(); err != nil {
+					break
+				}
+			}
+			options = append(options, o)
+		}
+		mounts = append(mounts, specs.Mount{
+			Destination: "/" + dest,
+			Type:        "tmpfs",
+			Source:      source,
+			Options:     options,
+		})
+	}
+
+	spec := &specs.Spec{
+		Root:   &specs.Root{Path: "rootfs"},
+		Linux:  &specs.Linux{},
+		Mounts: mounts,
+	}
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName: "fuzz",
+		Spec:       spec,
+	})
+	if err != nil {
+		return 0
+	}
+	if len(config.Mounts) != len(mounts) {
+		panic(fmt.Sprintf("expected %d mounts, got %d", len(mounts), len(config.Mounts)))
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return 0
+	}
+	for i, m := range config.Mounts {
+		s := mounts[i]
+		if m.Destination == "" || m.Destination != s.Destination {
+			panic(fmt.Sprintf("mount %d: destination %q became %q", i, s.Destination, m.Destination))
+		}
+
+		var flags, ext int
+		var pgflags []int
+		var unknown []string
+		for _, o := range s.Options {
+			if f, ok := mountOptionFlags[o]; ok {
+				if f.clear {
+					flags &^= f.flag
+				} else {
+					flags |= f.flag
+				}
+			} else if f, ok := mountPropagationFlags[o]; ok {
+				pgflags = append(pgflags, f)
+			} else if o == "tmpcopyup" {
+				ext |= configs.EXT_COPYUP
+			} else {
+				unknown = append(unknown, o)
+			}
+		}
+		if m.Flags != flags {
+			panic(fmt.Sprintf("mount %d: options %q: expected flags %#x, got %#x", i, s.Options, flags, m.Flags))
+		}
+		if !reflect.DeepEqual(m.PropagationFlags, pgflags) {
+			panic(fmt.Sprintf("mount %d: options %q: expected propagation %#x, got %#x", i, s.Options, pgflags, m.PropagationFlags))
+		}
+		if m.Extensions != ext {
+			panic(fmt.Sprintf("mount %d: options %q: expected extensions %#x, got %#x", i, s.Options, ext, m.Extensions))
+		}
+		if m.Data != strings.Join(unknown, ",") {
+			panic(fmt.Sprintf("mount %d: options %q: expected data %q, got %q", i, s.Options, strings.Join(unknown, ","), m.Data))
+		}
+
+		device, source := s.Type, s.Source
+		if flags&unix.MS_BIND != 0 {
+			device = "bind"
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(cwd, source)
+			}
+		}
+		if m.Device != device || m.Source != source {
+			panic(fmt.Sprintf("mount %d: options %q: expected %s from %q, got %s from %q", i, s.Options, device, source, m.Device, m.Source))
+		}
+	}
+	return 1
+}
+
+// ociDefaultDevices are the device nodes the runtime spec requires in
+// every container. /dev/console and /dev/ptmx are left out, they are
+// set up with the terminal and the devpts mount instead.
+var ociDefaultDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty"}
+
+// rootlessDevices are device nodes a rootless container may ask for:
+// pseudo-devices that are also in the default list, and block and
+// character devices of real hardware.
+var rootlessDevices = []specs.LinuxDevice{
+	{Path: "/dev/null", Type: "c", Major: 1, Minor: 3},
+	{Path: "/dev/random", Type: "c", Major: 1, Minor: 8},
+	{Path: "/dev/sda", Type: "b", Major: 8, Minor: 0},
+	{Path: "/dev/loop0", Type: "b", Major: 7, Minor: 0},
+	{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229},
+	{Path: "/dev/kvm", Type: "c", Major: 10, Minor: 232},
+}
+
+// deviceAllowed tells whether the rules allow the access to the device,
+// with the last matching rule deciding it like the eBPF device filter.
+func deviceAllowed(rules []*devices.Rule, t devices.Type, major, minor int64, access rune) bool {
+	allowed := false
+	for _, r := range rules {
+		if (r.Type == devices.WildcardDevice || r.Type == t) &&
+			(r.Major == devices.Wildcard || r.Major == major) &&
+			(r.Minor == devices.Wildcard || r.Minor == minor) &&
+			strings.ContainsRune(string(r.Permissions), access) {
+			allowed = r.Allow
+		}
+	}
+	return allowed
+}
+
+// FuzzContainerLinuxRootlessDevices converts the rootless example spec
+// with some of rootlessDevices and with device rules of its own added
+// to it. Without any devices in the spec, the device nodes are exactly
+// the ones the runtime spec requires. In a user namespace the owner of
+// a device node given in the spec is ignored: all of them belong to the
+// root user of the container. ToRootless drops the resources of the
+// example spec, and without any rules all devices are denied. The
+// default rules follow the rules of the spec, so the default devices
+// stay usable even if a rule of the spec denies them, but a default
+// device listed in the spec loses its default rule. Reading or writing
+// such a device, or a block device, is only allowed if the rules of
+// the spec allow it.
+func FuzzContainerLinuxRootlessDevices(data []byte) int {
+	// We do not want any log output:
+	logrus.SetLevel(logrus.PanicLevel)
+
+	c := gofuzzheaders.NewConsumer(data)
+	spec := Example()
+	ToRootless(spec)
+	spec.Linux.Resources = &specs.LinuxResources{}
+	for _, d := range rootlessDevices {
+		include, err := c.GetBool()
+		if err != nil {
+			return -1
+		}
+		if !include {
+			continue
+		}
+		uid, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		owner := uint32(uid)
+		d.UID, d.GID = &owner, &owner
+		spec.Linux.Devices = append(spec.Linux.Devices, d)
+	}
+	for {
+		i, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		allow, err := c.GetBool()
+		if err != nil {
+			break
+		}
+		rule := specs.LinuxDeviceCgroup{Allow: allow, Access: "rwm"}
+		if i < len(rootlessDevices) {
+			d := rootlessDevices[i]
+			rule.Type, rule.Major, rule.Minor = d.Type, &d.Major, &d.Minor
+		} else if i%2 == 0 {
+			// All block devices:
+			rule.Type = "b"
+		}
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, rule)
+	}
+	specRules := len(spec.Linux.Resources.Devices)
+
+	config, err := CreateLibcontainerConfig(&CreateOpts{
+		CgroupName:      "fuzz",
+		Spec:            spec,
+		RootlessEUID:    true,
+		RootlessCgroups: true,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert devices %+v: %v", spec.Linux.Devices, err))
+	}
+
+	paths := map[string]int{}
+	for _, d := range config.Devices {
+		paths[d.Path]++
+		if d.Uid != uint32(os.Geteuid()) || d.Gid != uint32(os.Getegid()) {
+			panic(fmt.Sprintf("device %q is owned by %d:%d instead of the container's root", d.Path, d.Uid, d.Gid))
+		}
+	}
+	for _, p := range ociDefaultDevices {
+		if paths[p] != 1 {
+			panic(fmt.Sprintf("default device %q is created %d times", p, paths[p]))
+		}
+	}
+	if len(spec.Linux.Devices) == 0 && len(paths) != len(ociDefaultDevices) {
+		panic(fmt.Sprintf("default devices %v differ from the runtime spec's %v", paths, ociDefaultDevices))
+	}
+
+	listed := map[string]bool{}
+	for _, d := range spec.Linux.Devices {
+		listed[d.Path] = true
+	}
+	rules := config.Cgroups.Resources.Devices
+	for _, d := range config.Devices {
+		for _, access := range "rw" {
+			allowed := deviceAllowed(rules, d.Type, d.Major, d.Minor, access)
+			if d.Type == devices.BlockDevice || listed[d.Path] {
+				if allowed != deviceAllowed(rules[:specRules], d.Type, d.Major, d.Minor, access) {
+					panic(fmt.Sprintf("access %c to device %q from the spec is allowed: %v", access, d.Path, allowed))
+				}
+			} else if !allowed {
+				panic(fmt.Sprintf("access %c to default device %q is denied", access, d.Path))
+			}
+		}
+	}
+	return 1
+}
@@ -0,0 +1,78 @@
+// +build gofuzz
+
+package system
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+)
+
+// statStates are values of the state field of /proc/<pid>/stat:
+// the states of proc(5), states of older kernels, and values that
+// are longer than one character.
+var statStates = []string{"R", "S", "D", "Z", "T", "t", "X", "x", "I", "P", "W", "K", "RS", "Z+", "é", ""}
+
+// FuzzParsePIDStatState parses fuzzed /proc/<pid>/stat lines. The comm
+// field may contain spaces, parentheses and anything that looks like a
+// state, so the state is the first character after the last ')'. A
+// line may be cut anywhere, as if the process went away while it was
+// read, and that has to give an error, not a panic.
+func FuzzParsePIDStatState(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	pid, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	comm, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	s, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	state := statStates[s%len(statStates)]
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	fields := []string{state}
+	for i := 0; i < n%52; i++ {
+		fields = append(fields, strconv.Itoa(i+4))
+	}
+	line := fmt.Sprintf("%d (%s) %s\n", pid, comm, strings.Join(fields, " "))
+	cut, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	truncated := cut < len(line)
+	if truncated {
+		line = line[:cut]
+	}
+
+	stat, err := parseStat(line)
+	if truncated || len(fields) < 20 {
+		return 0
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %q: %v", line, err))
+	}
+	if stat.PID != uint(pid) || stat.Name != comm {
+		panic(fmt.Sprintf("%q was parsed as pid %d, comm %q", line, stat.PID, stat.Name))
+	}
+	expected, _ := utf8.DecodeRuneInString(state)
+	if state == "" {
+		expected = 0
+	}
+	if rune(stat.State) != expected {
+		panic(fmt.Sprintf("%q: expected state %q, got %q", line, expected, rune(stat.State)))
+	}
+	if stat.StartTime != 22 {
+		panic(fmt.Sprintf("%q: expected start time 22, got %d", line, stat.StartTime))
+	}
+	return 1
+}
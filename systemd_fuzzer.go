@@ -0,0 +1,251 @@
+// +build gofuzz
+
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+)
+
+// bitsToList converts the output of RangeToBits
+// back into a comma-separated list of cpus.
+func bitsToList(bits []byte) string {
+	var list []string
+	for i := 0; i < len(bits)*8; i++ {
+		if bits[len(bits)-1-i/8]&(1<<uint(i%8)) != 0 {
+			list = append(list, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// maxCpusetRange is the number of positions a list may describe in
+// total. RangeToBits sets ranges bit by bit and only limits positions
+// to 32 bits, so larger lists are not passed to it.
+const maxCpusetRange = 1 << 16
+
+// cpusetPositions collects the positions described by a cpuset list,
+// and whether RangeToBits is expected to accept it. ok is false if the
+// list describes more than maxCpusetRange positions.
+func cpusetPositions(list string) (positions map[int]bool, valid, ok bool) {
+	positions = make(map[int]bool)
+	total := uint64(0)
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return positions, false, true
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil || start > end {
+				return positions, false, true
+			}
+		}
+		total += end - start + 1
+		if end >= maxCpusetRange || total > maxCpusetRange {
+			return nil, false, false
+		}
+		for i := start; i <= end; i++ {
+			positions[int(i)] = true
+		}
+	}
+	return positions, len(positions) > 0, true
+}
+
+// FuzzContainerCpuSet converts the cpus and mems lists to bitmasks
+// and checks that exactly the positions in the lists are set, and that
+// the bitmasks convert back to the same lists.
+func FuzzContainerCpuSet(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	cpus, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+	mems, err := c.GetString()
+	if err != nil {
+		return -1
+	}
+
+	for _, mask := range []string{cpus, mems} {
+		expected, valid, ok := cpusetPositions(mask)
+		if !ok {
+			return 0
+		}
+		bits, err := RangeToBits(mask)
+		if !valid {
+			if err == nil {
+				panic(fmt.Sprintf("invalid list %q was accepted: %v", mask, bits))
+			}
+			continue
+		}
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse list %q: %v", mask, err))
+		}
+		if len(bits) == 0 || bits[0] == 0 {
+			panic(fmt.Sprintf("%q: mask has leading zero bytes: %v", mask, bits))
+		}
+
+		for i := 0; i < len(bits)*8; i++ {
+			set := bits[len(bits)-1-i/8]&(1<<uint(i%8)) != 0
+			if set != expected[i] {
+				panic(fmt.Sprintf("list %q: position %d is set: %t", mask, i, set))
+			}
+			delete(expected, i)
+		}
+		if len(expected) != 0 {
+			panic(fmt.Sprintf("list %q: positions %v are missing", mask, expected))
+		}
+
+		// The bitmask must describe the same set of cpus:
+		list := bitsToList(bits)
+		bits2, err := RangeToBits(list)
+		if err != nil {
+			panic(fmt.Sprintf("%q: could not parse %q: %v", mask, list, err))
+		}
+		if !bytes.Equal(bits, bits2) {
+			panic(fmt.Sprintf("%q: %v != %v", mask, bits, bits2))
+		}
+	}
+	return 1
+}
+
+// sliceSegments are names of slices in a cgroup parent, including
+// names with literal dashes and characters that have to be escaped.
+var sliceSegments = []string{
+	"system", "user", "user-1000", "machine", "kubepods", "besteffort", "pod-1234",
+	"a.b", "x.slice", "-", "a--b", `a\b`, "a/b", "",
+}
+
+// escapeSliceSegment escapes a name the way systemd-escape does for
+// the parts of a unit name: a dash would start a new level of the
+// hierarchy, so it is written as \x2d.
+func escapeSliceSegment(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '-', '\\', '/':
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeSliceSegment reverses escapeSliceSegment.
+func unescapeSliceSegment(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FuzzExpandSliceRoundTrip encodes a cgroup parent as a slice name and
+// expands it into the path of the slice. runc does not escape names:
+// every dash is a level of the hierarchy, so the names of the levels
+// are escaped here first. The last element of the path must decode to
+// the same levels, and every element must be the slice of one level.
+// Names that are used as they are must be rejected if they have empty
+// levels or a slash, as they could not be expanded unambiguously.
+func FuzzExpandSliceRoundTrip(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	escape, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	n, err := c.GetInt()
+	if err != nil {
+		return -1
+	}
+	segments := []string{}
+	for i := 0; i < n%6; i++ {
+		s, err := c.GetInt()
+		if err != nil {
+			return -1
+		}
+		segment := sliceSegments[s%len(sliceSegments)]
+		if s >= len(sliceSegments) {
+			if segment, err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+		segments = append(segments, segment)
+	}
+
+	if !escape {
+		// Use the levels as they are:
+		slice := strings.Join(segments, "-") + ".slice"
+		path, err := ExpandSlice(slice)
+		if err != nil {
+			return 0
+		}
+		name := strings.TrimSuffix(slice, ".slice")
+		if name == "-" {
+			if path != "/" {
+				panic(fmt.Sprintf("root slice %q expanded to %q", slice, path))
+			}
+			return 1
+		}
+		if strings.Contains(slice, "/") || strings.Contains(name, "--") ||
+			strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") || name == "" {
+			panic(fmt.Sprintf("ambiguous slice %q expanded to %q", slice, path))
+		}
+		if elems := strings.Split(path, "/"); elems[len(elems)-1] != slice {
+			panic(fmt.Sprintf("slice %q expanded to %q", slice, path))
+		}
+		return 1
+	}
+
+	// Empty levels can not be escaped, and two of them are the root slice:
+	if len(segments) == 0 {
+		return -1
+	}
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		if s == "" {
+			return -1
+		}
+		escaped[i] = escapeSliceSegment(s)
+	}
+	slice := strings.Join(escaped, "-") + ".slice"
+	path, err := ExpandSlice(slice)
+	if err != nil {
+		panic(fmt.Sprintf("failed to expand slice %q of %q: %v", slice, segments, err))
+	}
+
+	elems := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(elems) != len(segments) {
+		panic(fmt.Sprintf("slice %q of %d levels expanded to %q", slice, len(segments), path))
+	}
+	for i, elem := range elems {
+		if expected := strings.Join(escaped[:i+1], "-") + ".slice"; elem != expected {
+			panic(fmt.Sprintf("slice %q expanded to %q: expected %q at level %d", slice, path, expected, i))
+		}
+	}
+	decoded := strings.Split(strings.TrimSuffix(elems[len(elems)-1], ".slice"), "-")
+	for i := range decoded {
+		decoded[i] = unescapeSliceSegment(decoded[i])
+	}
+	if fmt.Sprintf("%q", decoded) != fmt.Sprintf("%q", segments) {
+		panic(fmt.Sprintf("%q was encoded as %q and decoded as %q", segments, slice, decoded))
+	}
+	return 1
+}
@@ -0,0 +1,103 @@
+// +build gofuzz
+
+package user
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+)
+
+// subIDFields are fields of /etc/subuid and /etc/subgid lines: the
+// names the fuzzed user is known by, other names, and numbers that
+// are negative, too large for an id or not numbers at all.
+var subIDFields = []string{
+	"fuzz", "1000", "root", "", "0", "1", "65536", "100000", "-1", "4294967295", "4294967296",
+	"9223372036854775807", "abc", "1e3", " 1", "0x10",
+}
+
+// FuzzParseSubIDRanges parses a fuzzed subuid file with the filter
+// CurrentUserSubUIDs() uses for a user "fuzz" with uid 1000. runc
+// does not validate the file: missing fields and numbers it cannot
+// parse are left at 0, numbers out of range are clamped, extra fields
+// are ignored, and ranges that overlap or whose start plus count
+// overflows are returned as they are. The entries must match that,
+// line by line, and come out the same when written and parsed again.
+func FuzzParseSubIDRanges(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	var lines []string
+	for {
+		n, err := c.GetInt()
+		if err != nil {
+			break
+		}
+		var fields []string
+		for i := 0; i < 1+n%5; i++ {
+			j, err := c.GetInt()
+			if err != nil {
+				break
+			}
+			f := subIDFields[j%len(subIDFields)]
+			if j >= len(subIDFields) {
+				if f, err = c.GetString(); err != nil {
+					break
+				}
+			}
+			fields = append(fields, f)
+		}
+		line := strings.Join(fields, ":")
+		if strings.ContainsAny(line, "\r\n") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	filter := func(entry SubID) bool {
+		return entry.Name == "fuzz" || entry.Name == "1000"
+	}
+	out, err := ParseSubIDFilter(strings.NewReader(strings.Join(lines, "\n")), filter)
+	if err != nil {
+		return 0
+	}
+
+	var expected []SubID
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		s := SubID{Name: fields[0]}
+		if len(fields) > 1 {
+			s.SubID, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+		if len(fields) > 2 {
+			s.Count, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		if filter(s) {
+			expected = append(expected, s)
+		}
+	}
+	if len(out) != len(expected) {
+		panic(fmt.Sprintf("%q was parsed as %+v instead of %+v", lines, out, expected))
+	}
+	for i := range out {
+		if out[i] != expected[i] {
+			panic(fmt.Sprintf("%q was parsed as %+v instead of %+v", lines, out, expected))
+		}
+	}
+
+	for _, s := range out {
+		line := fmt.Sprintf("%s:%d:%d", s.Name, s.SubID, s.Count)
+		again, err := ParseSubIDFilter(strings.NewReader(line), nil)
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse %q: %v", line, err))
+		}
+		if len(again) != 1 || again[0] != s {
+			panic(fmt.Sprintf("%+v was parsed as %+v", s, again))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,56 @@
+// +build gofuzz
+
+package validate
+
+import (
+	"fmt"
+
+	gofuzzheaders "github.com/AdaLogics/go-fuzz-headers"
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// FuzzValidateIntelRdt runs only the Intel RDT stage of the validator.
+// A config without Intel RDT must be accepted, and the same config
+// must get the same result twice. Which schemas are accepted depends
+// on the CAT and MBA features, which are detected once from the host
+// and cannot be driven from outside the intelrdt package, so the
+// fuzzer does not check them.
+func FuzzValidateIntelRdt(data []byte) int {
+	c := gofuzzheaders.NewConsumer(data)
+	hasRdt, err := c.GetBool()
+	if err != nil {
+		return -1
+	}
+	config := &configs.Config{}
+	if hasRdt {
+		config.IntelRdt = &configs.IntelRdt{}
+		for _, schema := range []*string{&config.IntelRdt.L3CacheSchema, &config.IntelRdt.MemBwSchema} {
+			set, err := c.GetBool()
+			if err != nil {
+				return -1
+			}
+			if !set {
+				continue
+			}
+			if *schema, err = c.GetString(); err != nil {
+				return -1
+			}
+		}
+	}
+
+	v := New().(*ConfigValidator)
+	err = v.intelrdt(config)
+	if err2 := v.intelrdt(config); (err == nil) != (err2 == nil) {
+		panic(fmt.Sprintf("validation of %+v is not consistent: %v, %v", config.IntelRdt, err, err2))
+	}
+	if config.IntelRdt == nil {
+		if err != nil {
+			panic(fmt.Sprintf("config without Intel RDT was rejected: %v", err))
+		}
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+	return 1
+}